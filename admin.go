@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// Setting names containing any of these are masked when the configuration is shown.
+var secretSettingNames = []string{"secret", "key", "password", "token"}
+
+var ingestionPaused int32
+
+// IngestionPaused returns true while an operator has paused ingestion through the admin API.
+func IngestionPaused() bool {
+	return atomic.LoadInt32(&ingestionPaused) == 1
+}
+
+func startAdminServer(address string, token string) {
+	if token == "" {
+		log.Fatalln("AdminToken must be set to enable the admin API.")
+	}
+
+	log.Printf("Admin API listening on: %v\n", address)
+	log.Fatal(http.ListenAndServe(address, NewAdminRouter(token)))
+}
+
+// NewAdminRouter returns the handler for the admin API. Every request must carry the token as a bearer token.
+func NewAdminRouter(token string) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/v0/buffers", ListBuffers).Methods("GET")
+	router.HandleFunc("/v0/flush", FlushBuffers).Methods("POST")
+	router.HandleFunc("/v0/pause", PauseIngestion).Methods("POST")
+	router.HandleFunc("/v0/resume", ResumeIngestion).Methods("POST")
+	router.HandleFunc("/v0/config", ShowConfig).Methods("GET")
+	router.HandleFunc("/v0/tail", TailPayloads).Methods("GET")
+	return RequireToken(token, router)
+}
+
+// RequireToken only passes on requests with an "Authorization: Bearer <token>" header matching the token.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListBuffers shows the buffered payloads of every backend.
+func ListBuffers(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string][]BufferStats)
+	for _, name := range backends.Names() {
+		stats[name] = backends.Backend(name).GetBufferStats()
+	}
+	writeJson(w, stats)
+}
+
+// FlushBuffers writes out buffered payloads now. The backend, warehouse and schema query parameters narrow down
+// what is flushed, and flush everything when left out.
+func FlushBuffers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	names := backends.Names()
+	if name := query.Get("backend"); name != "" {
+		if backends.Backend(name) == nil {
+			http.Error(w, "Unknown backend", http.StatusNotFound)
+			return
+		}
+		names = []string{name}
+	}
+
+	flushed := make(map[string]int)
+	for _, name := range names {
+		flushed[name] = backends.Backend(name).Flush(query.Get("warehouse"), query.Get("schema"))
+	}
+
+	log.Printf("Flushed buffers through the admin API: %v\n", flushed)
+	writeJson(w, flushed)
+}
+
+// PauseIngestion makes the server answer every new payload with 503 until ingestion is resumed.
+func PauseIngestion(w http.ResponseWriter, r *http.Request) {
+	atomic.StoreInt32(&ingestionPaused, 1)
+	log.Println("Ingestion paused through the admin API")
+	writeJson(w, map[string]bool{"paused": true})
+}
+
+func ResumeIngestion(w http.ResponseWriter, r *http.Request) {
+	atomic.StoreInt32(&ingestionPaused, 0)
+	log.Println("Ingestion resumed through the admin API")
+	writeJson(w, map[string]bool{"paused": false})
+}
+
+// ShowConfig returns the effective configuration, with secrets masked.
+func ShowConfig(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, MaskSecrets(CurrentSettings().AllSettings()))
+}
+
+// MaskSecrets returns a copy of the settings with the values of secret looking settings replaced.
+func MaskSecrets(settings map[string]interface{}) map[string]interface{} {
+	masked := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			masked[key] = MaskSecrets(v)
+		case []interface{}:
+			var items []interface{}
+			for _, item := range v {
+				switch m := item.(type) {
+				case map[string]interface{}:
+					items = append(items, MaskSecrets(m))
+				case map[interface{}]interface{}:
+					// Lists of maps are left as the YAML parser returned them.
+					converted := make(map[string]interface{}, len(m))
+					for k, itemValue := range m {
+						converted[fmt.Sprintf("%v", k)] = itemValue
+					}
+					items = append(items, MaskSecrets(converted))
+				default:
+					items = append(items, item)
+				}
+			}
+			masked[key] = items
+		default:
+			if isSecretSetting(key) && EncodeValue(value, "") != "" {
+				masked[key] = "********"
+			} else {
+				masked[key] = value
+			}
+		}
+	}
+	return masked
+}
+
+func isSecretSetting(key string) bool {
+	key = strings.ToLower(key)
+	for _, name := range secretSettingNames {
+		if strings.Contains(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Failed to write response: %v\n", err)
+	}
+}
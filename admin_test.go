@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for header, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+	} {
+		r := httptest.NewRequest("GET", "/v0/buffers", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, expected, w.Code, header)
+	}
+}
+
+func TestMaskSecrets(t *testing.T) {
+	masked := MaskSecrets(map[string]interface{}{
+		"s3bucketname":      "uplink",
+		"s3secretaccesskey": "abc",
+		"iphashkey":         "",
+		"backends": map[string]interface{}{
+			"team_a": map[string]interface{}{"s3accesskeyid": "def", "type": "s3file"},
+		},
+		"redactionrules": []interface{}{
+			map[interface{}]interface{}{"name": "emails", "hmackey": "ghi"},
+		},
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"s3bucketname":      "uplink",
+		"s3secretaccesskey": "********",
+		"iphashkey":         "",
+		"backends": map[string]interface{}{
+			"team_a": map[string]interface{}{"s3accesskeyid": "********", "type": "s3file"},
+		},
+		"redactionrules": []interface{}{
+			map[string]interface{}{"name": "emails", "hmackey": "********"},
+		},
+	}, masked)
+}
+
+func TestBufferedBackendFlush(t *testing.T) {
+	var written []*Batch
+	b := bufferedBackend{
+		payloadChannel: make(chan *Payload, 10),
+		commandChannel: make(chan func(pool FlushPool)),
+		buffer:         NewPayloadBuffer(),
+		limits:         BufferLimits{EntriesPerFile: 100},
+		flushWorkers:   1,
+	}
+
+	done := make(chan bool, 10)
+	go b.runLoop(func(batch *Batch) {
+		written = append(written, batch)
+		done <- true
+	})
+
+	b.GetPayloadChannel() <- &Payload{Warehouse: "dev", Schema: "events", ServerTimestamp: 5, Data: map[string]interface{}{"key": 1}}
+	b.GetPayloadChannel() <- &Payload{Warehouse: "dev", Schema: "clicks", ServerTimestamp: 7, Data: map[string]interface{}{"key": 1}}
+	b.GetPayloadChannel() <- &Payload{Warehouse: "dev", Schema: "events", ServerTimestamp: 9, Data: map[string]interface{}{"key": 1}}
+
+	assert.Eventually(t, func() bool {
+		return len(b.payloadChannel) == 0
+	}, time.Second, time.Millisecond)
+
+	stats := b.GetBufferStats()
+	if !assert.Len(t, stats, 2) {
+		return
+	}
+	assert.Equal(t, "clicks", stats[0].Schema)
+	assert.Equal(t, 2, stats[1].Payloads)
+	assert.Equal(t, int64(5), stats[1].OldestServerTimestamp)
+
+	assert.Equal(t, 1, b.Flush("dev", "events"))
+	<-done
+	assert.Len(t, written[0].Payloads, 2)
+	assert.Len(t, b.GetBufferStats(), 1)
+
+	assert.Equal(t, 1, b.Flush("", ""))
+	<-done
+	assert.Empty(t, b.GetBufferStats())
+}
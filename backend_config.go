@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const DefaultBackendName = "default"
+
+// BackendConfig reads the settings of one backend instance. Named backends are configured in the Backends section
+// of the config file, and fall back to the top level settings for anything they do not set themselves:
+//  Backends:
+//    team_a:
+//      Type: s3file
+//      S3BucketName: team-a-telemetry
+//      S3Prefix: uplink/
+//      Format: jsonl
+// The default backend is configured by the top level settings alone.
+type BackendConfig struct {
+	Name   string
+	prefix string
+}
+
+func NewBackendConfig(name string) BackendConfig {
+	if name == DefaultBackendName {
+		return BackendConfig{Name: name}
+	}
+	return BackendConfig{Name: name, prefix: ConfigBackends + "." + name + "."}
+}
+
+// The setting holding the output format of each type of backend.
+var backendFormatKeys = map[string]string{
+	BackendConsole:   ConfigConsoleFormat,
+	BackendLocalFile: ConfigLocalFileFormat,
+	BackendS3File:    ConfigS3FileFormat,
+}
+
+// Type returns the kind of backend, eg. s3file.
+func (c BackendConfig) Type() string {
+	if c.prefix == "" {
+		return c.GetString(ConfigBackend)
+	}
+	return viper.GetString(c.prefix + ConfigBackendType)
+}
+
+// Format returns the output format of the backend. A Format set on a named backend wins, then the setting for
+// this type of backend (eg. S3FileFormat), then the top level Format.
+func (c BackendConfig) Format(typeFormatKey string) string {
+	if c.prefix != "" && viper.IsSet(c.prefix+ConfigFormat) {
+		return viper.GetString(c.prefix + ConfigFormat)
+	}
+
+	if format := c.GetString(typeFormatKey); format != "" {
+		return format
+	}
+
+	return viper.GetString(ConfigFormat)
+}
+
+func (c BackendConfig) key(key string) string {
+	if c.prefix != "" && viper.IsSet(c.prefix+key) {
+		return c.prefix + key
+	}
+	return key
+}
+
+func (c BackendConfig) GetString(key string) string {
+	return viper.GetString(c.key(key))
+}
+
+func (c BackendConfig) GetInt(key string) int {
+	return viper.GetInt(c.key(key))
+}
+
+func (c BackendConfig) GetInt64(key string) int64 {
+	return viper.GetInt64(c.key(key))
+}
+
+func (c BackendConfig) GetBool(key string) bool {
+	return viper.GetBool(c.key(key))
+}
+
+func (c BackendConfig) GetStringList(key string) []string {
+	return GetStringList(c.key(key))
+}
+
+// BackendNames returns the names of all configured backends, including the default one.
+func BackendNames() []string {
+	names := []string{DefaultBackendName}
+	for name := range viper.GetStringMap(ConfigBackends) {
+		names = append(names, strings.ToLower(name))
+	}
+	return names
+}
+
+// NewBackend creates the backend of the configured type.
+func NewBackend(config BackendConfig) (Backend, error) {
+	switch backendType := config.Type(); backendType {
+	case BackendConsole:
+		return NewConsoleBackend(config), nil
+	case BackendLocalFile:
+		return NewLocalFileBackend(config), nil
+	case BackendS3File:
+		return NewS3FileBackend(config)
+	default:
+		return nil, fmt.Errorf("backend \"%v\" has unknown type \"%v\"", config.Name, backendType)
+	}
+}
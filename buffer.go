@@ -0,0 +1,213 @@
+package main
+
+import (
+	"sort"
+)
+
+// A Batch is the set of payloads of one warehouse, schema and time partition that are written out together as a
+// single file.
+type Batch struct {
+	Warehouse string
+	Schema    string
+	Partition Partition
+	Headers   []string
+	Payloads  []*Payload
+
+	// Approximate encoded size of the payloads, see EstimatePayloadSize.
+	Bytes int
+}
+
+// BufferLimits decide when buffered payloads have to be written out.
+type BufferLimits struct {
+	// A batch is written once it holds this many payloads.
+	EntriesPerFile int
+	// A batch is written once it holds this many bytes, if greater than zero.
+	MaxBytesPerFile int
+	// Once the batches of all schemas in the backend together hold more bytes than this, the largest ones are written early, if
+	// greater than zero.
+	MaxBufferedBytes int
+}
+
+func NewBufferLimits(config BackendConfig) BufferLimits {
+	return BufferLimits{
+		EntriesPerFile:   config.GetInt(ConfigEntriesPerFile),
+		MaxBytesPerFile:  config.GetInt(ConfigMaxBytesPerFile),
+		MaxBufferedBytes: config.GetInt(ConfigMaxBufferedBytes),
+	}
+}
+
+// IsFull returns true if the batch has reached the size of a file.
+func (l BufferLimits) IsFull(batch *Batch) bool {
+	if len(batch.Payloads) >= l.EntriesPerFile {
+		return true
+	}
+
+	return l.MaxBytesPerFile > 0 && batch.Bytes >= l.MaxBytesPerFile
+}
+
+type bufferKey struct {
+	warehouse string
+	schema    string
+	partition int64
+}
+
+// PayloadBuffer holds the payloads received for each warehouse, schema and time partition until they are written
+// out, along with the union of their data columns. It is not safe for concurrent use, and is owned by a backend's Run goroutine.
+type PayloadBuffer struct {
+	batches map[bufferKey]*Batch
+	bytes   int
+}
+
+func NewPayloadBuffer() *PayloadBuffer {
+	return &PayloadBuffer{
+		batches: make(map[bufferKey]*Batch),
+	}
+}
+
+// Add stores the payload in the given time partition, and returns the batch it was added to.
+func (b *PayloadBuffer) Add(payload *Payload, partition Partition) *Batch {
+	key := bufferKey{warehouse: payload.Warehouse, schema: payload.Schema, partition: partition.Start}
+
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &Batch{
+			Warehouse: payload.Warehouse,
+			Schema:    payload.Schema,
+			Partition: partition,
+			Headers:   []string{},
+			Payloads:  []*Payload{},
+		}
+		b.batches[key] = batch
+	}
+
+	size := EstimatePayloadSize(payload)
+
+	batch.Headers = MergeColumns(batch.Headers, payload)
+	batch.Payloads = append(batch.Payloads, payload)
+	batch.Bytes += size
+
+	b.bytes += size
+	metricBufferedBytes.Add(int64(size))
+
+	return batch
+}
+
+// Take removes and returns the buffered batch for the warehouse, schema and partition, or nil if nothing is
+// buffered for it.
+func (b *PayloadBuffer) Take(warehouse string, schema string, partition Partition) *Batch {
+	key := bufferKey{warehouse: warehouse, schema: schema, partition: partition.Start}
+
+	batch, ok := b.batches[key]
+	if !ok {
+		return nil
+	}
+
+	delete(b.batches, key)
+
+	b.bytes -= batch.Bytes
+	metricBufferedBytes.Add(int64(-batch.Bytes))
+
+	return batch
+}
+
+// TakeMatching removes and returns the batches for the warehouse and schema, in every partition. An empty warehouse
+// or schema matches all of them.
+func (b *PayloadBuffer) TakeMatching(warehouse string, schema string) []*Batch {
+	var batches []*Batch
+	for key, batch := range b.batches {
+		if (warehouse == "" || key.warehouse == warehouse) && (schema == "" || key.schema == schema) {
+			batches = append(batches, b.Take(key.warehouse, key.schema, batch.Partition))
+		}
+	}
+	return batches
+}
+
+// TakeEnded removes and returns the batches of time partitions that ended at or before now, in milliseconds.
+func (b *PayloadBuffer) TakeEnded(now int64) []*Batch {
+	var batches []*Batch
+	for _, batch := range b.batches {
+		if batch.Partition.End != 0 && batch.Partition.End <= now {
+			batches = append(batches, b.Take(batch.Warehouse, batch.Schema, batch.Partition))
+		}
+	}
+
+	// Oldest first, so that files are written in order.
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].Partition.Start < batches[j].Partition.Start
+	})
+
+	return batches
+}
+
+// TakeOverflow removes and returns the largest batches until no more than maxBytes remain buffered.
+func (b *PayloadBuffer) TakeOverflow(maxBytes int) []*Batch {
+	var batches []*Batch
+	if maxBytes <= 0 {
+		return batches
+	}
+
+	for b.bytes > maxBytes && len(b.batches) > 0 {
+		var largest *Batch
+		for _, batch := range b.batches {
+			if largest == nil || batch.Bytes > largest.Bytes {
+				largest = batch
+			}
+		}
+
+		batches = append(batches, b.Take(largest.Warehouse, largest.Schema, largest.Partition))
+	}
+
+	return batches
+}
+
+// Stats describes every buffered batch, sorted by warehouse, schema and partition.
+func (b *PayloadBuffer) Stats() []BufferStats {
+	now := GetMillis()
+
+	stats := []BufferStats{}
+	for _, batch := range b.batches {
+		stats = append(stats, BufferStats{
+			Warehouse:             batch.Warehouse,
+			Schema:                batch.Schema,
+			Partition:             batch.Partition.Label,
+			Payloads:              len(batch.Payloads),
+			Bytes:                 batch.Bytes,
+			OldestServerTimestamp: batch.Payloads[0].ServerTimestamp,
+			OldestAgeSeconds:      float64(now-batch.Payloads[0].ServerTimestamp) / 1000,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Warehouse != stats[j].Warehouse {
+			return stats[i].Warehouse < stats[j].Warehouse
+		}
+		if stats[i].Schema != stats[j].Schema {
+			return stats[i].Schema < stats[j].Schema
+		}
+		return stats[i].Partition < stats[j].Partition
+	})
+
+	return stats
+}
+
+// Bytes returns the approximate size of everything in the buffer.
+func (b *PayloadBuffer) Bytes() int {
+	return b.bytes
+}
+
+// EstimatePayloadSize returns roughly how many bytes the payload takes up once encoded. It is used to bound memory
+// use and file sizes, so it only needs to be in the right ballpark for every output format.
+func EstimatePayloadSize(payload *Payload) int {
+	// The timestamps, and the separators between the fixed columns.
+	size := len(payload.Id) + len(payload.Source) + 32
+
+	for key, value := range payload.Data {
+		size += len(key) + len(EncodeValue(value, "")) + 2
+	}
+
+	for key, value := range payload.Server {
+		size += len(key) + len(EncodeValue(value, "")) + 2
+	}
+
+	return size
+}
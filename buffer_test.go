@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadBuffer(t *testing.T) {
+	buffer := NewPayloadBuffer()
+
+	assert.Len(t, buffer.Add(&Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{"b_key": 1}}, Partition{}).Payloads, 1)
+	assert.Len(t, buffer.Add(&Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{"a_key": 1, "b_key": 2}}, Partition{}).Payloads, 2)
+	assert.Len(t, buffer.Add(&Payload{Warehouse: "prod", Schema: "events", Data: map[string]interface{}{"c_key": 1}}, Partition{}).Payloads, 1)
+
+	batch := buffer.Take("dev", "events", Partition{})
+	assert.Equal(t, "dev", batch.Warehouse)
+	assert.Equal(t, []string{"b_key", "a_key"}, batch.Headers)
+	assert.Len(t, batch.Payloads, 2)
+
+	assert.Nil(t, buffer.Take("dev", "events", Partition{}))
+	assert.Len(t, buffer.Take("prod", "events", Partition{}).Payloads, 1)
+	assert.Equal(t, 0, buffer.Bytes())
+}
+
+func TestPayloadBufferOverflow(t *testing.T) {
+	buffer := NewPayloadBuffer()
+
+	for i := 0; i < 10; i++ {
+		buffer.Add(&Payload{Warehouse: "dev", Schema: "large", Data: map[string]interface{}{"value": strings.Repeat("x", 100)}}, Partition{})
+	}
+	buffer.Add(&Payload{Warehouse: "dev", Schema: "small", Data: map[string]interface{}{"value": "x"}}, Partition{})
+
+	assert.Empty(t, buffer.TakeOverflow(0))
+	assert.Empty(t, buffer.TakeOverflow(buffer.Bytes()))
+
+	overflow := buffer.TakeOverflow(buffer.Bytes() - 1)
+	assert.Len(t, overflow, 1)
+	assert.Equal(t, "large", overflow[0].Schema)
+	assert.NotNil(t, buffer.Take("dev", "small", Partition{}))
+}
+
+func TestBufferLimits(t *testing.T) {
+	limits := BufferLimits{EntriesPerFile: 2, MaxBytesPerFile: 100}
+
+	assert.False(t, limits.IsFull(&Batch{Payloads: make([]*Payload, 1), Bytes: 99}))
+	assert.True(t, limits.IsFull(&Batch{Payloads: make([]*Payload, 2), Bytes: 1}))
+	assert.True(t, limits.IsFull(&Batch{Payloads: make([]*Payload, 1), Bytes: 100}))
+}
+
+func TestFlushPoolKeepsSchemaOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	flushed := map[string][]int{}
+
+	pool := NewFlushPool(4, 1, func(batch *Batch) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		flushed[batch.Schema] = append(flushed[batch.Schema], len(batch.Payloads))
+		wg.Done()
+	})
+
+	for i := 1; i <= 20; i++ {
+		for _, schema := range []string{"aa", "bb", "cc"} {
+			wg.Add(1)
+			pool.Submit(&Batch{Warehouse: "dev", Schema: schema, Payloads: make([]*Payload, i)})
+		}
+	}
+	wg.Wait()
+
+	for _, schema := range []string{"aa", "bb", "cc"} {
+		for i, count := range flushed[schema] {
+			assert.Equal(t, i+1, count)
+		}
+	}
+}
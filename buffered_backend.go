@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// BufferStats describes what a backend is holding for one warehouse and schema.
+type BufferStats struct {
+	Warehouse string `json:"warehouse"`
+	Schema    string `json:"schema"`
+	Partition string `json:"partition,omitempty"`
+	Payloads  int    `json:"payloads"`
+	Bytes     int    `json:"bytes"`
+	// Server timestamp of the oldest buffered payload, and how long ago that was.
+	OldestServerTimestamp int64   `json:"oldest_server_timestamp"`
+	OldestAgeSeconds      float64 `json:"oldest_age_seconds"`
+}
+
+// bufferedBackend is the part shared by the backends that collect payloads into files. Its run loop owns the
+// buffer, so everything else that needs to look at or change the buffer is sent to the loop as a command.
+type bufferedBackend struct {
+	payloadChannel chan *Payload
+	commandChannel chan func(pool FlushPool)
+
+	buffer   *PayloadBuffer
+	limits   BufferLimits
+	rotation RotationPolicy
+
+	sweepInterval  int64
+	flushWorkers   int
+	flushQueueSize int
+}
+
+func newBufferedBackend(config BackendConfig) bufferedBackend {
+	return bufferedBackend{
+		payloadChannel: make(chan *Payload, config.GetInt(ConfigQueueSize)),
+		commandChannel: make(chan func(pool FlushPool)),
+		buffer:         NewPayloadBuffer(),
+		limits:         NewBufferLimits(config),
+		rotation:       NewRotationPolicy(config),
+		sweepInterval:  config.GetInt64(ConfigSweepInterval),
+		flushWorkers:   config.GetInt(ConfigFlushWorkers),
+		flushQueueSize: config.GetInt(ConfigFlushQueueSize),
+	}
+}
+
+// runLoop buffers payloads, handing batches to write on a pool of workers as they fill up. When files are rotated
+// at time boundaries, the batches of partitions that have ended are written out every SweepInterval seconds too. It
+// never returns.
+func (b bufferedBackend) runLoop(write func(batch *Batch)) {
+	pool := NewFlushPool(b.flushWorkers, b.flushQueueSize, write)
+
+	var sweep <-chan time.Time
+	if b.rotation.Enabled() && b.sweepInterval > 0 {
+		ticker := time.NewTicker(time.Duration(b.sweepInterval) * time.Second)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
+	for {
+		select {
+		case payload := <-b.payloadChannel:
+			b.storePayload(pool, payload)
+		case command := <-b.commandChannel:
+			command(pool)
+		case <-sweep:
+			for _, batch := range b.buffer.TakeEnded(GetMillis()) {
+				log.Printf("Writing Warehouse: %v and Schema: %v for the ended partition %v\n", batch.Warehouse, batch.Schema, batch.Partition.Label)
+				pool.Submit(batch)
+			}
+		}
+	}
+}
+
+func (b bufferedBackend) storePayload(pool FlushPool, payload *Payload) {
+	partition := b.rotation.Partition(payload)
+	batch := b.buffer.Add(payload, partition)
+
+	log.Printf("Payloads Length for Warehouse: %v and Schema: %v is: %v\n", payload.Warehouse, payload.Schema, len(batch.Payloads))
+
+	if b.limits.IsFull(batch) {
+		pool.Submit(b.buffer.Take(payload.Warehouse, payload.Schema, partition))
+	}
+
+	for _, overflow := range b.buffer.TakeOverflow(b.limits.MaxBufferedBytes) {
+		log.Printf("Writing Warehouse: %v and Schema: %v early to keep buffered data under %v bytes\n", overflow.Warehouse, overflow.Schema, b.limits.MaxBufferedBytes)
+		pool.Submit(overflow)
+	}
+}
+
+func (b bufferedBackend) GetPayloadChannel() chan<- *Payload {
+	return b.payloadChannel
+}
+
+func (b bufferedBackend) GetBufferStats() []BufferStats {
+	result := make(chan []BufferStats)
+	b.commandChannel <- func(pool FlushPool) {
+		result <- b.buffer.Stats()
+	}
+	return <-result
+}
+
+func (b bufferedBackend) Flush(warehouse string, schema string) int {
+	result := make(chan int)
+	b.commandChannel <- func(pool FlushPool) {
+		batches := b.buffer.TakeMatching(warehouse, schema)
+		for _, batch := range batches {
+			pool.Submit(batch)
+		}
+		result <- len(batches)
+	}
+	return <-result
+}
+
+func (b bufferedBackend) Health() BackendHealth {
+	return BackendHealth{Healthy: true}
+}
+
+func (b bufferedBackend) Drain() {
+	done := make(chan struct{})
+	b.commandChannel <- func(pool FlushPool) {
+		// Payloads still in the queue were sent before Drain was called, so they are written out too.
+		for len(b.payloadChannel) > 0 {
+			b.storePayload(pool, <-b.payloadChannel)
+		}
+
+		for _, batch := range b.buffer.TakeMatching("", "") {
+			pool.Submit(batch)
+		}
+
+		pool.Wait()
+		close(done)
+	}
+	<-done
+}
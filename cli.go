@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Build information, set when building a release with:
+//  go build -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse HEAD) -X main.BuildDate=$(date -u +%FT%TZ)"
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// Set up in init, since the help command refers back to the list.
+	commands = []command{
+		{"serve", "serve [flags]", "Run the server (the default when no command is given)", runServe},
+		{"validate", "validate [flags] <file>", "Check a file of JSON payloads, one per line, without sending them anywhere", runValidate},
+		{"replay", "replay [flags] <file>...", "Send historical payloads from JSON or CSV files through to a backend", runReplay},
+		{"config", "config check [flags]", "Print the resolved configuration and report any problems with it", runConfig},
+		{"version", "version", "Print the version and build information", runVersion},
+		{"help", "help", "Show this help", runHelp},
+	}
+}
+
+// RunCommand runs the command named by the first argument, and returns the exit code of the process. Without a
+// command the server is started, as it always was.
+func RunCommand(args []string) int {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+		return runHelp(nil)
+	}
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command \"%v\".\n\n", args[0])
+	printUsage(os.Stderr)
+	return 2
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: uplink <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-26v %v\n", c.usage, c.description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run \"uplink <command> --help\" for the flags of a command.")
+}
+
+// newFlagSet returns the flags for a command, including the --config flag shared by all of them.
+func newFlagSet(name string) (*pflag.FlagSet, *string) {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	configFile := flags.StringP("config", "c", "", "Config file to read, instead of the UPLINK_CONFIGFILE environment variable")
+	return flags, configFile
+}
+
+// loadConfig sets up the configuration, reading the config file given on the command line if there is one.
+func loadConfig(configFile string) {
+	if configFile != "" {
+		viper.Set(ConfigFile, configFile)
+	}
+	setupConfig()
+	ReserveServerColumns()
+}
+
+func runServe(args []string) int {
+	flags, configFile := newFlagSet("serve")
+	if err := flags.Parse(args); err != nil {
+		return exitCodeForParseError(err)
+	}
+
+	loadConfig(*configFile)
+	serve()
+	return 0
+}
+
+func runValidate(args []string) int {
+	flags, configFile := newFlagSet("validate")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: uplink validate [flags] <file>")
+		fmt.Fprintln(os.Stderr, "Use - as the file to read from standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitCodeForParseError(err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	loadConfig(*configFile)
+
+	input := os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer file.Close()
+		input = file
+	}
+
+	valid, invalid, err := ValidateJsonLines(input, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fmt.Printf("%v valid, %v invalid\n", valid, invalid)
+	if invalid > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ValidateJsonLines checks each line of r as a payload, the same way the server does when it receives one, and
+// writes a message to w for every line that would be rejected. Blank lines are skipped.
+func ValidateJsonLines(r io.Reader, w io.Writer) (int, int, error) {
+	reader := bufio.NewReader(r)
+	valid := 0
+	invalid := 0
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return valid, invalid, err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if message := validateLine(trimmed); message != nil {
+				fmt.Fprintf(w, "line %v: %v\n", lineNumber, *message)
+				invalid++
+			} else {
+				valid++
+			}
+		}
+
+		if err == io.EOF {
+			return valid, invalid, nil
+		}
+	}
+}
+
+func validateLine(line []byte) *string {
+	var payload Payload
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return newString(fmt.Sprintf("Failed to decode payload: %v", err))
+	}
+
+	// Checks relative to the time the server receives a payload are made against the current time.
+	payload.ServerTimestamp = GetMillis()
+
+	rejection, _ := CheckPayload(&payload)
+	return rejection
+}
+
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: uplink config check [flags]")
+		return 2
+	}
+
+	flags, configFile := newFlagSet("config check")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitCodeForParseError(err)
+	}
+
+	loadConfig(*configFile)
+
+	settings, err := json.MarshalIndent(MaskSecrets(viper.AllSettings()), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Println(string(settings))
+
+	problems := CheckConfig()
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "Problem: %v\n", problem)
+	}
+
+	if len(problems) > 0 {
+		return 1
+	}
+
+	fmt.Fprintln(os.Stderr, "Configuration OK")
+	return 0
+}
+
+// CheckConfig looks for settings the server would fail on, or silently ignore, and describes each of them.
+func CheckConfig() []string {
+	var problems []string
+	seen := make(map[string]bool)
+	report := func(problem string) {
+		if !seen[problem] {
+			seen[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+
+	for _, name := range BackendNames() {
+		config := NewBackendConfig(name)
+		formatKey, ok := backendFormatKeys[config.Type()]
+		if !ok {
+			report(fmt.Sprintf("backend \"%v\" has unknown type \"%v\"", name, config.Type()))
+			continue
+		}
+
+		if format := config.Format(formatKey); NewRecordEncoder(format, "") == nil {
+			report(fmt.Sprintf("backend \"%v\" has unknown format \"%v\"", name, format))
+		}
+
+		switch interval := config.GetString(ConfigRotationInterval); interval {
+		case "", RotationMinute, RotationHour, RotationDay:
+		default:
+			report(fmt.Sprintf("backend \"%v\" has unknown %v \"%v\"", name, ConfigRotationInterval, interval))
+		}
+
+		switch clock := config.GetString(ConfigRotationClock); clock {
+		case RotationClockServer, RotationClockClient:
+		default:
+			report(fmt.Sprintf("backend \"%v\" has unknown %v \"%v\"", name, ConfigRotationClock, clock))
+		}
+
+		if config.Type() == BackendConsole {
+			switch mode := config.GetString(ConfigConsoleMode); mode {
+			case ConsoleModePretty, ConsoleModeJson, ConsoleModeCsv:
+			default:
+				report(fmt.Sprintf("backend \"%v\" has unknown %v \"%v\"", name, ConfigConsoleMode, mode))
+			}
+		}
+
+		if config.Type() == BackendS3File {
+			if _, err := NewS3Credentials(config); err != nil {
+				report(err.Error())
+			}
+			if _, err := NewS3ObjectOptions(config); err != nil {
+				report(err.Error())
+			}
+		}
+	}
+
+	if _, err := NewBackendRouter(); err != nil {
+		report(err.Error())
+	}
+
+	for _, key := range schemaSettingKeys(ConfigFormat) {
+		if format := viper.GetString(key); NewRecordEncoder(format, "") == nil {
+			report(fmt.Sprintf("%v is set to unknown format \"%v\"", key, format))
+		}
+	}
+
+	for _, key := range schemaSettingKeys(ConfigNestedDataMode) {
+		switch mode := viper.GetString(key); mode {
+		case NestedDataModeFlatten, NestedDataModeJson, NestedDataModeReject:
+		default:
+			report(fmt.Sprintf("%v is set to unknown mode \"%v\"", key, mode))
+		}
+	}
+
+	for _, key := range schemaSettingKeys(ConfigValidationMode) {
+		switch mode := viper.GetString(key); mode {
+		case ValidationModeStrict, ValidationModeLenient:
+		default:
+			report(fmt.Sprintf("%v is set to unknown mode \"%v\"", key, mode))
+		}
+	}
+
+	for _, key := range schemaSettingKeys(ConfigTimestampBoundsAction) {
+		switch action := viper.GetString(key); action {
+		case TimestampBoundsReject, TimestampBoundsFlag:
+		default:
+			report(fmt.Sprintf("%v is set to unknown action \"%v\"", key, action))
+		}
+	}
+
+	if _, err := newRedactor(); err != nil {
+		report(err.Error())
+	}
+
+	if err := checkIpHashKey(viper.GetString(ConfigIpAnonymization), []byte(viper.GetString(ConfigIpHashKey))); err != nil {
+		report(err.Error())
+	}
+
+	if _, err := NewDeadLetterQueue(); err != nil {
+		report(err.Error())
+	}
+
+	if viper.GetString(ConfigAdminListenAddress) != "" && viper.GetString(ConfigAdminToken) == "" {
+		report(fmt.Sprintf("%v is set without an %v", ConfigAdminListenAddress, ConfigAdminToken))
+	}
+
+	return problems
+}
+
+// schemaSettingKeys returns the keys of every per warehouse and per schema override of the setting, sorted. The top
+// level setting is included too.
+func schemaSettingKeys(key string) []string {
+	keys := []string{key}
+	for warehouse := range viper.GetStringMap("Warehouses") {
+		warehouseKey := fmt.Sprintf("Warehouses.%v.%v", warehouse, key)
+		if viper.IsSet(warehouseKey) {
+			keys = append(keys, warehouseKey)
+		}
+
+		for schema := range viper.GetStringMap(fmt.Sprintf("Warehouses.%v.Schemas", warehouse)) {
+			schemaKey := fmt.Sprintf("Warehouses.%v.Schemas.%v.%v", warehouse, schema, key)
+			if viper.IsSet(schemaKey) {
+				keys = append(keys, schemaKey)
+			}
+		}
+	}
+	sort.Strings(keys[1:])
+	return keys
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("uplink %v\n", Version)
+
+	commit := Commit
+	buildDate := BuildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		// Binaries built from a checkout without ldflags still record the revision they were built from.
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildDate == "":
+				buildDate = setting.Value
+			}
+		}
+	}
+
+	if commit != "" {
+		fmt.Printf("commit: %v\n", commit)
+	}
+	if buildDate != "" {
+		fmt.Printf("built: %v\n", buildDate)
+	}
+	fmt.Printf("go: %v %v/%v\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
+
+func runHelp(args []string) int {
+	printUsage(os.Stdout)
+	return 0
+}
+
+func exitCodeForParseError(err error) int {
+	if err == pflag.ErrHelp {
+		return 0
+	}
+	return 2
+}
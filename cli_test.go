@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateJsonLines(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	viper.Set(ConfigNestedDataMode, NestedDataModeReject)
+	LoadSettings()
+
+	input := strings.Join([]string{
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1, "data": {"name": "a"}}`,
+		``,
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1, "data": {"Name": "a"}}`,
+		`not json`,
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1, "data": {"nested": {"a": 1}}}`,
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 2, "data": {"name": "b"}}`,
+	}, "\n")
+
+	var output bytes.Buffer
+	valid, invalid, err := ValidateJsonLines(strings.NewReader(input), &output)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, valid)
+	assert.Equal(t, 3, invalid)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.True(t, strings.HasPrefix(lines[0], "line 3: Data key \"Name\""))
+		assert.True(t, strings.HasPrefix(lines[1], "line 4: Failed to decode payload"))
+		assert.True(t, strings.HasPrefix(lines[2], "line 5: "))
+	}
+}
+
+func TestValidateJsonLinesChecksLikeTheServer(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	setupConfig()
+	viper.Set(ConfigMaxPastMillis, 60000)
+	viper.Set(ConfigTimestampBoundsAction, TimestampBoundsReject)
+	viper.Set("Warehouses.dev.Schemas.retired.Disable", DisableReject)
+	LoadSettings()
+
+	now := GetMillis()
+	input := strings.Join([]string{
+		fmt.Sprintf(`{"warehouse": "dev", "schema": "events", "client_timestamp": %v, "data": {"name": "a"}}`, now),
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1, "data": {"name": "b"}}`,
+		fmt.Sprintf(`{"warehouse": "dev", "schema": "retired", "client_timestamp": %v, "data": {"name": "c"}}`, now),
+	}, "\n")
+
+	var output bytes.Buffer
+	valid, invalid, err := ValidateJsonLines(strings.NewReader(input), &output)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, valid)
+	assert.Equal(t, 2, invalid)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[0], "line 2: Payload rejected, because its event time is"))
+		assert.Equal(t, "line 3: Schema \"retired\" in warehouse \"dev\" is currently disabled", lines[1])
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer viper.Reset()
+	setupConfig()
+
+	assert.Empty(t, CheckConfig())
+
+	viper.Set(ConfigBackends, map[string]interface{}{
+		"archive": map[string]interface{}{"Type": "tape"},
+		"files":   map[string]interface{}{"Type": BackendLocalFile, "Format": "xml"},
+	})
+	viper.Set(ConfigRoutes, []interface{}{
+		map[string]interface{}{"Warehouse": "*", "Backend": "missing"},
+	})
+	viper.Set("Warehouses", map[string]interface{}{
+		"dev": map[string]interface{}{"NestedDataMode": "explode"},
+	})
+	viper.Set(ConfigRedactionRules, []interface{}{
+		map[string]interface{}{"Name": "hash_ids", "Hmac": []interface{}{"user_id"}},
+	})
+	viper.Set(ConfigIpAnonymization, IpAnonymizationHash)
+	viper.Set(ConfigIpHashKey, "secret")
+
+	problems := CheckConfig()
+	assert.Contains(t, problems, "backend \"archive\" has unknown type \"tape\"")
+	assert.Contains(t, problems, "backend \"files\" has unknown format \"xml\"")
+	assert.Contains(t, problems, "route to backend \"missing\", which is not configured")
+	assert.Contains(t, problems, "Warehouses.dev.NestedDataMode is set to unknown mode \"explode\"")
+	assert.Contains(t, problems, "redaction rule hash_ids hashes fields, but RedactionHmacKey is shorter than 32 bytes")
+	assert.Contains(t, problems, "IpAnonymization is hash, but IpHashKey is shorter than 32 bytes")
+}
+
+func TestRunCommandRejectsUnknownCommands(t *testing.T) {
+	assert.Equal(t, 2, RunCommand([]string{"nonsense"}))
+	assert.Equal(t, 0, RunCommand([]string{"version"}))
+}
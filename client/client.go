@@ -21,6 +21,7 @@ type payload struct {
 	Source          string                 `json:"source"`
 	Schema          string                 `json:"schema"`
 	ClientTimestamp int64                  `json:"client_timestamp"`
+	SentAt          int64                  `json:"sent_at"`
 	Data            map[string]interface{} `json:"data"`
 }
 
@@ -70,6 +71,9 @@ func (c *Client) worker() {
 	for {
 		select {
 		case p := <-c.payloadChannel:
+			// Lets the server work out how far the clock of this machine is off.
+			p.SentAt = getMillis()
+
 			b, err := json.Marshal(&p)
 			if err != nil {
 				log.Printf("A json marshalling error occurred: %v\n", err.Error())
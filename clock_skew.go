@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// How far the client's clock was ahead of the server's when it sent the payload, in milliseconds.
+	ColumnClockSkew = "clock_skew_millis"
+	// The client timestamp with the clock skew taken out, in server time.
+	ColumnAdjustedTimestamp = "adjusted_client_timestamp"
+)
+
+const (
+	// Payloads with a timestamp out of bounds are rejected.
+	TimestampBoundsReject = "reject"
+	// Payloads with a timestamp out of bounds are accepted with a warning.
+	TimestampBoundsFlag = "flag"
+)
+
+// CheckTimestamps corrects the client timestamp for clock skew and checks it is within the configured bounds of
+// the server time. The skew is only known if the client sent a sent_at timestamp, taken from the same clock as the
+// client timestamp just before sending. It returns why the payload was rejected, if it was.
+func CheckTimestamps(payload *Payload) *string {
+	warehouse, schema := payload.Warehouse, payload.Schema
+
+	eventTime := payload.ClientTimestamp
+	if GetSchemaBool(warehouse, schema, ConfigClockSkewCorrection) {
+		if adjusted, ok := recordedAdjustedTimestamp(payload); ok {
+			// Replayed from a file uplink wrote, which kept the correction it made at the time.
+			eventTime = adjusted
+		} else if payload.SentAt > 0 {
+			skew := payload.SentAt - payload.ServerTimestamp
+			eventTime -= skew
+			payload.SetServerValue(ColumnClockSkew, skew)
+		} else {
+			payload.SetServerValue(ColumnClockSkew, nil)
+		}
+		payload.SetServerValue(ColumnAdjustedTimestamp, eventTime)
+	}
+
+	var problem string
+	if maxFuture := GetSchemaInt(warehouse, schema, ConfigMaxFutureMillis); maxFuture > 0 && eventTime > payload.ServerTimestamp+int64(maxFuture) {
+		problem = fmt.Sprintf("event time is %v in the future", millisDuration(eventTime-payload.ServerTimestamp))
+	}
+	if maxPast := GetSchemaInt(warehouse, schema, ConfigMaxPastMillis); maxPast > 0 && eventTime < payload.ServerTimestamp-int64(maxPast) {
+		problem = fmt.Sprintf("event time is %v in the past", millisDuration(payload.ServerTimestamp-eventTime))
+	}
+
+	if problem == "" {
+		return nil
+	}
+
+	if GetSchemaString(warehouse, schema, ConfigTimestampBoundsAction) == TimestampBoundsReject {
+		return newString(fmt.Sprintf("Payload rejected, because its %v", problem))
+	}
+
+	payload.AddWarning(problem)
+	return nil
+}
+
+// recordedAdjustedTimestamp returns the adjusted timestamp of a payload replayed from a file uplink wrote with clock
+// skew correction on. The skew cannot be worked out again, since files do not keep sent_at.
+func recordedAdjustedTimestamp(payload *Payload) (int64, bool) {
+	if payload.SentAt > 0 {
+		return 0, false
+	}
+	if _, ok := payload.Server[ColumnClockSkew]; !ok {
+		return 0, false
+	}
+
+	adjusted, err := strconv.ParseInt(EncodeValue(payload.Server[ColumnAdjustedTimestamp], ""), 10, 64)
+	return adjusted, err == nil
+}
+
+func millisDuration(millis int64) time.Duration {
+	return time.Duration(millis) * time.Millisecond
+}
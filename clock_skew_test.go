@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTimestampsCorrectsSkew(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	viper.Set(ConfigClockSkewCorrection, true)
+	LoadSettings()
+
+	// The client's clock is an hour ahead.
+	payload := &Payload{ClientTimestamp: 3600000 + 1000, SentAt: 3600000 + 5000, ServerTimestamp: 5100}
+	assert.Nil(t, CheckTimestamps(payload))
+	assert.Equal(t, int64(3600000-100), payload.Value(ColumnClockSkew))
+	assert.Equal(t, int64(1100), payload.Value(ColumnAdjustedTimestamp))
+
+	// Without sent_at the skew is unknown, and the client timestamp is used as it is.
+	payload = &Payload{ClientTimestamp: 1000, ServerTimestamp: 5100}
+	assert.Nil(t, CheckTimestamps(payload))
+	assert.Nil(t, payload.Value(ColumnClockSkew))
+	assert.Contains(t, payload.Server, ColumnClockSkew)
+	assert.Equal(t, int64(1000), payload.Value(ColumnAdjustedTimestamp))
+
+	viper.Set(ConfigClockSkewCorrection, false)
+	LoadSettings()
+	payload = &Payload{ClientTimestamp: 1000, SentAt: 2000, ServerTimestamp: 5100}
+	assert.Nil(t, CheckTimestamps(payload))
+	assert.Nil(t, payload.Server)
+}
+
+func TestCheckTimestampsBounds(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	viper.Set(ConfigMaxFutureMillis, 1000)
+	viper.Set(ConfigMaxPastMillis, 60000)
+	viper.Set(ConfigTimestampBoundsAction, TimestampBoundsFlag)
+	viper.Set("Warehouses.strict.TimestampBoundsAction", TimestampBoundsReject)
+	LoadSettings()
+
+	payload := &Payload{Warehouse: "dev", ClientTimestamp: 100000, ServerTimestamp: 100500}
+	assert.Nil(t, CheckTimestamps(payload))
+	assert.Nil(t, payload.Server)
+
+	payload = &Payload{Warehouse: "dev", ClientTimestamp: 102000, ServerTimestamp: 100000}
+	assert.Nil(t, CheckTimestamps(payload))
+	assert.Equal(t, "event time is 2s in the future", payload.Value(ColumnWarnings))
+
+	payload = &Payload{Warehouse: "dev", ClientTimestamp: 1, ServerTimestamp: 100000}
+	payload.AddWarning("renamed userId to user_id")
+	assert.Nil(t, CheckTimestamps(payload))
+	assert.Equal(t, "renamed userId to user_id; event time is 1m39.999s in the past", payload.Value(ColumnWarnings))
+
+	payload = &Payload{Warehouse: "strict", ClientTimestamp: 1, ServerTimestamp: 100000}
+	result := CheckTimestamps(payload)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, "Payload rejected, because its event time is 1m39.999s in the past", *result)
+	}
+}
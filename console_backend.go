@@ -1,23 +1,61 @@
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"sort"
+	"time"
+)
+
+const (
+	// One colourized line per event, showing warehouse, schema, timestamps and data.
+	ConsoleModePretty = "pretty"
+	// Each payload as a raw JSON line.
+	ConsoleModeJson = "json"
+	// Delimited records, preceded by a header line whenever the schema or its columns change from the previous record.
+	ConsoleModeCsv = "csv"
+)
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiDim   = "\x1b[2m"
+	ansiBold  = "\x1b[1m"
+	ansiCyan  = "\x1b[36m"
+	ansiGreen = "\x1b[32m"
 )
 
 type ConsoleBackend struct {
-	schemaWriterMap  map[string]*csv.Writer
-	schemaHeadersMap map[string][]*string
+	schemaHeadersMap map[string][]string
 	payloadChannel   chan *Payload
+	drainChannel     chan chan struct{}
+	output           io.Writer
+	nullValue        string
+	format           string
+
+	mode       string
+	color      bool
+	warehouses map[string]bool
+	schemas    map[string]bool
+
+	// The warehouse and schema of the last record printed in csv mode, whose header the next record can share.
+	lastSchema *string
 }
 
-func NewConsoleBackend() Backend {
+func NewConsoleBackend(config BackendConfig) Backend {
 	return ConsoleBackend{
-		schemaWriterMap:  make(map[string]*csv.Writer),
-		schemaHeadersMap: make(map[string][]*string),
-		payloadChannel:   make(chan *Payload),
+		schemaHeadersMap: make(map[string][]string),
+		lastSchema:       new(string),
+		payloadChannel:   make(chan *Payload, config.GetInt(ConfigQueueSize)),
+		drainChannel:     make(chan chan struct{}),
+		output:           os.Stdout,
+		nullValue:        config.GetString(ConfigNullValue),
+		format:           config.Format(ConfigConsoleFormat),
+		mode:             config.GetString(ConfigConsoleMode),
+		color:            config.GetBool(ConfigConsoleColor),
+		warehouses:       toSet(config.GetStringList(ConfigConsoleWarehouses)),
+		schemas:          toSet(config.GetStringList(ConfigConsoleSchemas)),
 	}
 }
 
@@ -25,74 +63,136 @@ func (b ConsoleBackend) Run() {
 	for {
 		select {
 		case payload := <-b.payloadChannel:
-			w := b.getWriter(payload)
-			w.Write(b.convertPayloadToStringList(payload))
-			w.Flush()
+			b.print(payload)
+		case done := <-b.drainChannel:
+			for len(b.payloadChannel) > 0 {
+				b.print(<-b.payloadChannel)
+			}
+			close(done)
 		}
 	}
 }
 
+func (b ConsoleBackend) print(payload *Payload) {
+	if !b.shouldPrint(payload) {
+		return
+	}
+
+	switch b.mode {
+	case ConsoleModeJson:
+		b.printJson(payload)
+	case ConsoleModeCsv:
+		b.printCsv(payload)
+	default:
+		b.printPretty(payload)
+	}
+}
+
 func (b ConsoleBackend) GetPayloadChannel() chan<- *Payload {
 	return b.payloadChannel
 }
 
-func (b ConsoleBackend) GetHeaders(schema string) []*string {
-	headers, ok := b.schemaHeadersMap[schema]
-	if ok {
-		return headers
-	}
+// GetBufferStats returns nothing, since the console backend prints payloads as soon as they arrive.
+func (b ConsoleBackend) GetBufferStats() []BufferStats {
+	return []BufferStats{}
+}
+
+func (b ConsoleBackend) Flush(warehouse string, schema string) int {
+	return 0
+}
+
+// Health always reports the console backend as healthy, since printing does not fail.
+func (b ConsoleBackend) Health() BackendHealth {
+	return BackendHealth{Healthy: true}
+}
 
-	headers = []*string{}
-	b.schemaHeadersMap[schema] = headers
-	return headers
+// Drain waits until every payload sent so far has been printed.
+func (b ConsoleBackend) Drain() {
+	done := make(chan struct{})
+	b.drainChannel <- done
+	<-done
 }
 
-func (b ConsoleBackend) convertPayloadToStringList(payload *Payload) []string {
-	var keys []string
-	for key := range payload.Data {
-		keys = append(keys, key)
+func (b ConsoleBackend) shouldPrint(payload *Payload) bool {
+	if len(b.warehouses) > 0 && !b.warehouses[payload.Warehouse] {
+		return false
 	}
-	sort.Strings(keys)
 
-	oldKeys, ok := b.schemaHeadersMap[payload.Schema]
-	if !ok {
-		oldKeys = []*string{}
-		b.schemaHeadersMap[payload.Schema] = oldKeys
+	if len(b.schemas) > 0 && !b.schemas[payload.Schema] {
+		return false
 	}
 
-	for _, newKey := range keys {
-		found := false
-		for _, oldKey := range oldKeys {
-			if *oldKey == newKey {
-				found = true
-				break
-			}
-		}
-		if !found {
-			oldKeys = append(oldKeys, &newKey)
-		}
+	return true
+}
+
+func (b ConsoleBackend) printJson(payload *Payload) {
+	w := NewRecordEncoder(FormatJsonLines, b.nullValue).NewWriter(b.output)
+	w.WriteRecord(nil, payload)
+	w.Flush()
+}
+
+func (b ConsoleBackend) printCsv(payload *Payload) {
+	key := payload.Warehouse + "/" + payload.Schema
+	oldHeaders := b.schemaHeadersMap[key]
+	headers := MergeColumns(oldHeaders, payload)
+	b.schemaHeadersMap[key] = headers
+
+	// Records of different schemas can be interleaved, and each needs its own header right above it to be read.
+	sameSchema := *b.lastSchema == key
+	*b.lastSchema = key
+
+	encoder := EncoderForSchema(payload.Warehouse, payload.Schema, b.format, b.nullValue)
+	w := encoder.NewWriter(b.output)
+	if !sameSchema || len(headers) != len(oldHeaders) {
+		fmt.Fprintf(b.output, "# %v\n", key)
+		w.WriteHeader(headers)
 	}
+	w.WriteRecord(headers, payload)
+	w.Flush()
+}
+
+func (b ConsoleBackend) printPretty(payload *Payload) {
+	var line bytes.Buffer
+	line.WriteString(b.colorize(ansiDim, formatMillis(payload.ServerTimestamp)))
+	line.WriteString(" ")
+	line.WriteString(b.colorize(ansiBold+ansiCyan, payload.Warehouse+"/"+payload.Schema))
+	fmt.Fprintf(&line, " %v=%v %v=%v %v=%v",
+		b.colorize(ansiDim, "id"), payload.Id,
+		b.colorize(ansiDim, "source"), payload.Source,
+		b.colorize(ansiDim, "client_time"), formatMillis(payload.ClientTimestamp))
 
-	var stringList []string
-	stringList = append(stringList, payload.Source)
-	for _, key := range oldKeys {
-		data, ok := payload.Data[*key]
-		if !ok {
-			data = ""
+	for _, key := range MergeColumns(nil, payload) {
+		value, err := json.Marshal(payload.Value(key))
+		if err != nil {
+			value = []byte(EncodeValue(payload.Value(key), b.nullValue))
 		}
-		stringList = append(stringList, fmt.Sprintf("%v", data))
+
+		keyColor := ansiGreen
+		if IsServerColumn(key) {
+			keyColor = ansiDim
+		}
+		fmt.Fprintf(&line, " %v=%s", b.colorize(keyColor, key), value)
 	}
-	return stringList
+
+	line.WriteString("\n")
+	b.output.Write(line.Bytes())
 }
 
-func (b ConsoleBackend) getWriter(payload *Payload) *csv.Writer {
-	writer, ok := b.schemaWriterMap[payload.Schema]
-	if ok {
-		return writer
+func (b ConsoleBackend) colorize(code string, text string) string {
+	if !b.color {
+		return text
 	}
+	return code + text + ansiReset
+}
+
+func formatMillis(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
 
-	writer = csv.NewWriter(os.Stdout)
-	writer.Comma = '|'
-	b.schemaWriterMap[payload.Schema] = writer
-	return writer
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsoleBackendPrint(t *testing.T) {
+	first := &Payload{Id: "a", Warehouse: "dev", Schema: "events", Source: "web", ServerTimestamp: 1527858000000, ClientTimestamp: 1527857999000, Data: map[string]interface{}{"key_one": "x"}}
+	second := &Payload{Id: "b", Warehouse: "dev", Schema: "events", Source: "web", ServerTimestamp: 1527858001000, ClientTimestamp: 1527858000500, Data: map[string]interface{}{"key_one": "y"}}
+	wider := &Payload{Id: "c", Warehouse: "dev", Schema: "events", Source: "web", ServerTimestamp: 1527858002000, ClientTimestamp: 1527858001500, Data: map[string]interface{}{"key_one": "z", "key_two": 2}, Server: map[string]interface{}{ColumnWarnings: "late"}}
+	other := &Payload{Id: "d", Warehouse: "prod", Schema: "clicks", Source: "app", ServerTimestamp: 1527858003000, ClientTimestamp: 1527858003000, Data: map[string]interface{}{}}
+
+	for name, test := range map[string]struct {
+		backend  ConsoleBackend
+		payloads []*Payload
+		expected string
+	}{
+		"pretty": {
+			backend:  ConsoleBackend{mode: ConsoleModePretty},
+			payloads: []*Payload{wider},
+			expected: "2018-06-01T13:00:02.000Z dev/events id=c source=web client_time=2018-06-01T13:00:01.500Z _uplink_warnings=\"late\" key_one=\"z\" key_two=2\n",
+		},
+		"pretty in color": {
+			backend:  ConsoleBackend{mode: ConsoleModePretty, color: true},
+			payloads: []*Payload{first},
+			expected: "\x1b[2m2018-06-01T13:00:00.000Z\x1b[0m \x1b[1m\x1b[36mdev/events\x1b[0m \x1b[2mid\x1b[0m=a \x1b[2msource\x1b[0m=web \x1b[2mclient_time\x1b[0m=2018-06-01T12:59:59.000Z \x1b[32mkey_one\x1b[0m=\"x\"\n",
+		},
+		"json": {
+			backend:  ConsoleBackend{mode: ConsoleModeJson},
+			payloads: []*Payload{first},
+			expected: `{"id":"a","warehouse":"dev","source":"web","schema":"events","client_timestamp":1527857999000,"server_timestamp":1527858000000,"data":{"key_one":"x"}}` + "\n",
+		},
+		"csv repeats the header when the schema changes between records": {
+			backend:  ConsoleBackend{mode: ConsoleModeCsv, format: FormatCsv, nullValue: `\N`},
+			payloads: []*Payload{first, other, second},
+			expected: "# dev/events\nid,source,server_timestamp,client_timestamp,key_one\na,web,1527858000000,1527857999000,x\n" +
+				"# prod/clicks\nid,source,server_timestamp,client_timestamp\nd,app,1527858003000,1527858003000\n" +
+				"# dev/events\nid,source,server_timestamp,client_timestamp,key_one\nb,web,1527858001000,1527858000500,y\n",
+		},
+		"csv repeats the header only when the columns change": {
+			backend:  ConsoleBackend{mode: ConsoleModeCsv, format: FormatCsv, nullValue: `\N`},
+			payloads: []*Payload{first, second, wider, other},
+			expected: "# dev/events\nid,source,server_timestamp,client_timestamp,key_one\na,web,1527858000000,1527857999000,x\n" +
+				"b,web,1527858001000,1527858000500,y\n" +
+				"# dev/events\nid,source,server_timestamp,client_timestamp,_uplink_warnings,key_one,key_two\nc,web,1527858002000,1527858001500,late,z,2\n" +
+				"# prod/clicks\nid,source,server_timestamp,client_timestamp\nd,app,1527858003000,1527858003000\n",
+		},
+		"warehouse filter": {
+			backend:  ConsoleBackend{mode: ConsoleModeJson, warehouses: toSet([]string{"prod"})},
+			payloads: []*Payload{first, other},
+			expected: `{"id":"d","warehouse":"prod","source":"app","schema":"clicks","client_timestamp":1527858003000,"server_timestamp":1527858003000,"data":{}}` + "\n",
+		},
+		"schema filter": {
+			backend:  ConsoleBackend{mode: ConsoleModeJson, schemas: toSet([]string{"clicks", "views"})},
+			payloads: []*Payload{first, second, other},
+			expected: `{"id":"d","warehouse":"prod","source":"app","schema":"clicks","client_timestamp":1527858003000,"server_timestamp":1527858003000,"data":{}}` + "\n",
+		},
+	} {
+		var output bytes.Buffer
+		b := test.backend
+		b.output = &output
+		b.schemaHeadersMap = make(map[string][]string)
+		b.lastSchema = new(string)
+
+		for _, payload := range test.payloads {
+			b.print(payload)
+		}
+
+		assert.Equal(t, test.expected, output.String(), name)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// Dead letters are written out at least this often, if there are any.
+	deadLetterFlushInterval = 10 * time.Second
+	// Dead letters are written out early once this many bytes of them are waiting.
+	deadLetterMaxFileBytes = 1024 * 1024
+)
+
+// DeadLetter is a request the server rejected, kept so the problem can be investigated and the payload recovered.
+type DeadLetter struct {
+	ReceivedAt int64  `json:"received_at"`
+	Reason     string `json:"reason"`
+	RemoteIp   string `json:"remote_ip,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	// The request body, cut short at DeadLetterMaxBodyBytes.
+	Body      string `json:"body"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Set when the redaction rules have been applied to the data of the body, so replays do not apply them again.
+	Redacted bool `json:"redacted,omitempty"`
+	// Set when the body was left out, because the redaction rules could not be applied to it.
+	Withheld bool `json:"withheld,omitempty"`
+}
+
+// DeadLetterQueue collects rejected requests and writes them in JSON lines files to the configured sink, either
+// a local directory or a prefix in the S3 bucket. Adding a dead letter never waits: when the queue is full, or the
+// hourly size cap has been reached, the dead letter is counted and thrown away.
+//
+// The redaction rules are applied to the data of the bodies, so that dead letters do not keep what the rules keep
+// out of the backends. Bodies they cannot be applied to, because they are not JSON objects, are left out, unless
+// DeadLetterRawBodies is set. When there are no redaction rules, every body is kept as received.
+type DeadLetterQueue struct {
+	channel  chan DeadLetter
+	write    func(name string, data []byte) error
+	redactor *Redactor
+	// Keep bodies the redaction rules cannot be applied to as received.
+	rawBodies bool
+
+	instanceId      string
+	sampleRate      float64
+	maxBodyBytes    int
+	maxBytesPerHour int
+
+	sequence uint64
+}
+
+// NewDeadLetterQueue returns the queue for the configured sink, or nil if dead letters are not kept.
+func NewDeadLetterQueue() (*DeadLetterQueue, error) {
+	q := &DeadLetterQueue{
+		channel:         make(chan DeadLetter, viper.GetInt(ConfigQueueSize)),
+		instanceId:      viper.GetString(ConfigInstanceId),
+		sampleRate:      viper.GetFloat64(ConfigDeadLetterSampleRate),
+		maxBodyBytes:    viper.GetInt(ConfigDeadLetterMaxBodyBytes),
+		maxBytesPerHour: viper.GetInt(ConfigDeadLetterMaxBytesPerHour),
+		rawBodies:       viper.GetBool(ConfigDeadLetterRawBodies),
+	}
+
+	switch sink := viper.GetString(ConfigDeadLetterSink); sink {
+	case "":
+		return nil, nil
+	case BackendLocalFile:
+		q.write = localDeadLetterWriter(viper.GetString(ConfigDeadLetterDirectory))
+	case BackendS3File:
+		write, err := s3DeadLetterWriter(NewBackendConfig(DefaultBackendName), viper.GetString(ConfigDeadLetterS3Prefix))
+		if err != nil {
+			return nil, err
+		}
+		q.write = write
+	default:
+		return nil, fmt.Errorf("unknown dead letter sink \"%v\"", sink)
+	}
+
+	redactor, err := newRedactor()
+	if err != nil {
+		return nil, err
+	}
+	if len(redactor.rules) > 0 {
+		q.redactor = redactor
+	}
+
+	return q, nil
+}
+
+// Add queues the rejected request for writing, subject to sampling, with the redaction rules applied to its body.
+// It does nothing on a nil queue.
+func (q *DeadLetterQueue) Add(r *http.Request, body []byte, reason string) {
+	if q == nil || rand.Float64() >= q.sampleRate {
+		return
+	}
+
+	letter := DeadLetter{
+		ReceivedAt: GetMillis(),
+		Reason:     reason,
+		UserAgent:  r.UserAgent(),
+	}
+
+	if info := requestMetadata.NewRequestInfo(r); info.RemoteIp != nil {
+		letter.RemoteIp = requestMetadata.anonymizeIp(info.RemoteIp)
+	}
+
+	if q.redactor != nil {
+		if redacted, ok := q.redactor.RedactBody(body); ok {
+			body = redacted
+			letter.Redacted = true
+		} else if !q.rawBodies {
+			body = nil
+			letter.Withheld = true
+		}
+	}
+
+	if q.maxBodyBytes > 0 && len(body) > q.maxBodyBytes {
+		body = body[:q.maxBodyBytes]
+		letter.Truncated = true
+	}
+	letter.Body = string(body)
+
+	select {
+	case q.channel <- letter:
+	default:
+		metricDeadLettersSkipped.Add(1)
+	}
+}
+
+// Run writes out the queued dead letters. It never returns.
+func (q *DeadLetterQueue) Run() {
+	ticker := time.NewTicker(deadLetterFlushInterval)
+	defer ticker.Stop()
+
+	var pending bytes.Buffer
+	hour := time.Now().Truncate(time.Hour)
+	bytesThisHour := 0
+
+	for {
+		select {
+		case letter := <-q.channel:
+			if now := time.Now().Truncate(time.Hour); now != hour {
+				hour = now
+				bytesThisHour = 0
+			}
+
+			line, err := json.Marshal(letter)
+			if err != nil {
+				log.Printf("Failed to encode dead letter: %v\n", err)
+				continue
+			}
+
+			if q.maxBytesPerHour > 0 && bytesThisHour+len(line)+1 > q.maxBytesPerHour {
+				metricDeadLettersSkipped.Add(1)
+				continue
+			}
+
+			bytesThisHour += len(line) + 1
+			pending.Write(line)
+			pending.WriteByte('\n')
+
+			if pending.Len() >= deadLetterMaxFileBytes {
+				q.flush(&pending)
+			}
+		case <-ticker.C:
+			q.flush(&pending)
+		}
+	}
+}
+
+func (q *DeadLetterQueue) flush(pending *bytes.Buffer) {
+	if pending.Len() == 0 {
+		return
+	}
+
+	sequence := atomic.AddUint64(&q.sequence, 1)
+	name := fmt.Sprintf("deadletters-%v-%v-%06d.jsonl", q.instanceId, time.Now().Unix(), sequence)
+	count := bytes.Count(pending.Bytes(), []byte{'\n'})
+
+	if err := q.write(name, pending.Bytes()); err != nil {
+		log.Printf("Failed to write %v dead letters: %v\n", count, err)
+		metricDeadLettersSkipped.Add(int64(count))
+	} else {
+		metricDeadLettersWritten.Add(int64(count))
+	}
+
+	pending.Reset()
+}
+
+// localDeadLetterWriter writes dead letter files into the directory, through a temporary file like the localfile
+// backend does.
+func localDeadLetterWriter(directory string) func(name string, data []byte) error {
+	return func(name string, data []byte) error {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return err
+		}
+		return writeFileAtomically(filepath.Join(directory, name), data)
+	}
+}
+
+// s3DeadLetterWriter writes dead letter files under the prefix of the bucket the S3 settings point at.
+func s3DeadLetterWriter(config BackendConfig, prefix string) (func(name string, data []byte) error, error) {
+	client, err := NewS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := NewS3ObjectOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	options.ContentType = "application/x-ndjson"
+
+	bucketName := config.GetString(ConfigS3BucketName)
+	return func(name string, data []byte) error {
+		_, err := client.PutObject(bucketName, prefix+name, io.Reader(bytes.NewReader(data)), int64(len(data)), options)
+		return err
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterQueueAdd(t *testing.T) {
+	defer func(old *RequestMetadata) { requestMetadata = old }(requestMetadata)
+	requestMetadata = &RequestMetadata{ipAnonymization: IpAnonymizationTruncate}
+
+	q := &DeadLetterQueue{channel: make(chan DeadLetter, 1), sampleRate: 1, maxBodyBytes: 8}
+
+	r := httptest.NewRequest("POST", "/v0/log", nil)
+	r.RemoteAddr = "192.0.2.77:1234"
+	r.Header.Set("User-Agent", "test-agent")
+
+	q.Add(r, []byte(`{"warehouse": "dev"}`), "bad payload")
+	letter := <-q.channel
+	assert.Equal(t, "bad payload", letter.Reason)
+	assert.Equal(t, "192.0.2.0", letter.RemoteIp)
+	assert.Equal(t, "test-agent", letter.UserAgent)
+	assert.Equal(t, `{"wareho`, letter.Body)
+	assert.True(t, letter.Truncated)
+	assert.True(t, letter.ReceivedAt > 0)
+
+	// A full queue drops the dead letter instead of waiting.
+	q.Add(r, []byte("{}"), "first")
+	q.Add(r, []byte("{}"), "second")
+	assert.Equal(t, "first", (<-q.channel).Reason)
+
+	q.sampleRate = 0
+	q.Add(r, []byte("{}"), "sampled out")
+	assert.Len(t, q.channel, 0)
+
+	var nilQueue *DeadLetterQueue
+	nilQueue.Add(r, []byte("{}"), "ignored")
+}
+
+func TestDeadLetterQueueAddRedactsBodies(t *testing.T) {
+	defer func(old *RequestMetadata) { requestMetadata = old }(requestMetadata)
+	requestMetadata = &RequestMetadata{}
+
+	rules, err := newRedactionRules([]RedactionRuleConfig{{Drop: []string{"password"}, Hmac: []string{"user_id"}}})
+	if !assert.Nil(t, err) {
+		return
+	}
+	redactor := &Redactor{rules: rules, hmacKey: []byte("0123456789abcdef0123456789abcdef")}
+	q := &DeadLetterQueue{channel: make(chan DeadLetter, 1), sampleRate: 1, redactor: redactor}
+
+	r := httptest.NewRequest("POST", "/v0/log", nil)
+
+	q.Add(r, []byte(`{"warehouse": "dev", "schema": "Bad Schema", "client_timestamp": 1, "data": {"password": "hunter2", "user_id": 42}}`), "bad schema")
+	letter := <-q.channel
+	assert.NotContains(t, letter.Body, "hunter2")
+	assert.NotContains(t, letter.Body, "42")
+	assert.Contains(t, letter.Body, `"schema":"Bad Schema"`)
+	assert.Contains(t, letter.Body, `"user_id":"`)
+	assert.True(t, letter.Redacted)
+	assert.False(t, letter.Withheld)
+
+	q.Add(r, []byte(`{"data": {"password": "hunter2"`), "cut short")
+	letter = <-q.channel
+	assert.Empty(t, letter.Body)
+	assert.True(t, letter.Withheld)
+
+	q.rawBodies = true
+	q.Add(r, []byte(`{"data": {"password": "hunter2"`), "cut short")
+	letter = <-q.channel
+	assert.Equal(t, `{"data": {"password": "hunter2"`, letter.Body)
+	assert.False(t, letter.Redacted)
+	assert.False(t, letter.Withheld)
+}
+
+func TestDeadLetterQueueFlush(t *testing.T) {
+	var names []string
+	var written []string
+	q := &DeadLetterQueue{instanceId: "test", write: func(name string, data []byte) error {
+		names = append(names, name)
+		written = append(written, string(data))
+		return nil
+	}}
+
+	var pending bytes.Buffer
+	q.flush(&pending)
+	assert.Empty(t, names)
+
+	pending.WriteString("{}\n{}\n")
+	q.flush(&pending)
+	if assert.Len(t, names, 1) {
+		assert.True(t, strings.HasPrefix(names[0], "deadletters-test-"))
+		assert.True(t, strings.HasSuffix(names[0], "-000001.jsonl"))
+		assert.Equal(t, "{}\n{}\n", written[0])
+	}
+	assert.Equal(t, 0, pending.Len())
+}
+
+func TestLocalDeadLetterWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	write := localDeadLetterWriter(filepath.Join(dir, "nested"))
+	assert.Nil(t, write("letters.jsonl", []byte("{}\n")))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "nested", "letters.jsonl"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{}\n", string(data))
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "nested"))
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+)
+
+const (
+	FormatPipe      = "psv"
+	FormatCsv       = "csv"
+	FormatTsv       = "tsv"
+	FormatJsonLines = "jsonl"
+)
+
+// Columns written at the start of every record, ahead of the data columns of the schema.
+var fixedColumns = []string{"id", "source", "server_timestamp", "client_timestamp"}
+
+// A RecordEncoder turns payloads into the bytes of an output file (or console stream) in one particular format.
+type RecordEncoder interface {
+	NewWriter(w io.Writer) RecordWriter
+	FileExtension() string
+	ContentType() string
+}
+
+// A RecordWriter writes the records for a single file. The columns passed in are the data columns of the schema,
+// and must not change between the header and the records of the same file.
+type RecordWriter interface {
+	WriteHeader(columns []string) error
+	WriteRecord(columns []string, payload *Payload) error
+	Flush() error
+}
+
+// NewRecordEncoder returns the encoder for the named format, or nil if there is no such format.
+func NewRecordEncoder(format string, nullValue string) RecordEncoder {
+	switch format {
+	case FormatPipe:
+		return delimitedEncoder{comma: '|', extension: "csv", contentType: "text/plain", nullValue: nullValue}
+	case FormatCsv:
+		return delimitedEncoder{comma: ',', extension: "csv", contentType: "text/csv", nullValue: nullValue}
+	case FormatTsv:
+		return delimitedEncoder{comma: '\t', extension: "tsv", contentType: "text/tab-separated-values", nullValue: nullValue}
+	case FormatJsonLines:
+		return jsonLinesEncoder{}
+	default:
+		return nil
+	}
+}
+
+// EncoderForSchema returns the encoder to use for the given warehouse and schema. A Format set for the warehouse or
+// schema in the config file wins over the format of the backend.
+func EncoderForSchema(warehouse string, schema string, backendFormat string, nullValue string) RecordEncoder {
+	format := backendFormat
+	settings := CurrentSettings()
+	if key := settings.SchemaKey(warehouse, schema, ConfigFormat); key != ConfigFormat {
+		format = settings.GetString(key)
+	}
+
+	encoder := NewRecordEncoder(format, nullValue)
+	if encoder == nil {
+		log.Printf("Unknown format \"%v\" configured for warehouse: %v and schema: %v. Using %v instead.\n", format, warehouse, schema, FormatPipe)
+		encoder = NewRecordEncoder(FormatPipe, nullValue)
+	}
+
+	return encoder
+}
+
+// MergeColumns adds any server or data keys of the payload that are not already in columns, in sorted order. Server
+// added columns are kept together at the start of the list, ahead of all the data columns.
+func MergeColumns(columns []string, payload *Payload) []string {
+	serverColumns := 0
+	for serverColumns < len(columns) && IsServerColumn(columns[serverColumns]) {
+		serverColumns++
+	}
+
+	for _, newKey := range newColumns(columns, payload.Server) {
+		columns = append(columns, "")
+		copy(columns[serverColumns+1:], columns[serverColumns:])
+		columns[serverColumns] = newKey
+		serverColumns++
+	}
+
+	return append(columns, newColumns(columns, payload.Data)...)
+}
+
+func newColumns(columns []string, values map[string]interface{}) []string {
+	var keys []string
+	for key := range values {
+		found := false
+		for _, oldKey := range columns {
+			if oldKey == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type delimitedEncoder struct {
+	comma       rune
+	extension   string
+	contentType string
+	nullValue   string
+}
+
+func (e delimitedEncoder) NewWriter(w io.Writer) RecordWriter {
+	writer := csv.NewWriter(w)
+	writer.Comma = e.comma
+	return delimitedWriter{writer: writer, nullValue: e.nullValue}
+}
+
+func (e delimitedEncoder) FileExtension() string {
+	return e.extension
+}
+
+func (e delimitedEncoder) ContentType() string {
+	return e.contentType
+}
+
+type delimitedWriter struct {
+	writer    *csv.Writer
+	nullValue string
+}
+
+func (w delimitedWriter) WriteHeader(columns []string) error {
+	return w.writer.Write(append(append([]string{}, fixedColumns...), columns...))
+}
+
+func (w delimitedWriter) WriteRecord(columns []string, payload *Payload) error {
+	record := []string{
+		payload.Id,
+		payload.Source,
+		strconv.FormatInt(payload.ServerTimestamp, 10),
+		strconv.FormatInt(payload.ClientTimestamp, 10),
+	}
+	for _, key := range columns {
+		record = append(record, EncodeValue(payload.Value(key), w.nullValue))
+	}
+	return w.writer.Write(record)
+}
+
+func (w delimitedWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// jsonLinesEncoder writes each payload as a complete JSON object on its own line, so it needs no header.
+type jsonLinesEncoder struct{}
+
+func (e jsonLinesEncoder) NewWriter(w io.Writer) RecordWriter {
+	return jsonLinesWriter{encoder: json.NewEncoder(w)}
+}
+
+func (e jsonLinesEncoder) FileExtension() string {
+	return "jsonl"
+}
+
+func (e jsonLinesEncoder) ContentType() string {
+	return "application/x-ndjson"
+}
+
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+func (w jsonLinesWriter) WriteHeader(columns []string) error {
+	return nil
+}
+
+func (w jsonLinesWriter) WriteRecord(columns []string, payload *Payload) error {
+	return w.encoder.Encode(payload)
+}
+
+func (w jsonLinesWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEncoderPayload() *Payload {
+	return &Payload{
+		Id:              "abc",
+		Warehouse:       "dev",
+		Source:          "src",
+		Schema:          "events",
+		ClientTimestamp: 1000,
+		ServerTimestamp: 2000,
+		Data: map[string]interface{}{
+			"text":  "a,b\tc",
+			"count": json.Number("3"),
+		},
+	}
+}
+
+func TestRecordEncoders(t *testing.T) {
+	payload := newEncoderPayload()
+	columns := MergeColumns(nil, payload)
+	columns = append(columns, "missing")
+
+	for format, expected := range map[string]string{
+		FormatPipe:      "id|source|server_timestamp|client_timestamp|count|text|missing\nabc|src|2000|1000|3|a,b\tc|\\N\n",
+		FormatCsv:       "id,source,server_timestamp,client_timestamp,count,text,missing\nabc,src,2000,1000,3,\"a,b\tc\",\\N\n",
+		FormatTsv:       "id\tsource\tserver_timestamp\tclient_timestamp\tcount\ttext\tmissing\nabc\tsrc\t2000\t1000\t3\t\"a,b\tc\"\t\\N\n",
+		FormatJsonLines: `{"id":"abc","warehouse":"dev","source":"src","schema":"events","client_timestamp":1000,"server_timestamp":2000,"data":{"count":3,"text":"a,b\tc"}}` + "\n",
+	} {
+		var buffer bytes.Buffer
+		writer := NewRecordEncoder(format, "\\N").NewWriter(&buffer)
+		assert.Nil(t, writer.WriteHeader(columns))
+		assert.Nil(t, writer.WriteRecord(columns, payload))
+		assert.Nil(t, writer.Flush())
+		assert.Equal(t, expected, buffer.String(), format)
+	}
+
+	assert.Nil(t, NewRecordEncoder("xml", "\\N"))
+}
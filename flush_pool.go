@@ -0,0 +1,59 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// FlushPool writes out batches on a fixed set of worker goroutines, so that slow encoding or uploads do not hold
+// up the backend's Run loop. Batches are sharded by warehouse and schema, so the files for any one schema are
+// always written by the same worker, in the order they were submitted.
+type FlushPool struct {
+	queues  []chan *Batch
+	pending *sync.WaitGroup
+}
+
+func NewFlushPool(workers int, queueSize int, flush func(batch *Batch)) FlushPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := FlushPool{
+		queues:  make([]chan *Batch, workers),
+		pending: &sync.WaitGroup{},
+	}
+
+	for i := range pool.queues {
+		queue := make(chan *Batch, queueSize)
+		pool.queues[i] = queue
+
+		go func() {
+			for batch := range queue {
+				flush(batch)
+				pool.pending.Done()
+			}
+		}()
+	}
+
+	return pool
+}
+
+// Submit queues the batch on the worker for its warehouse and schema. It blocks while that worker's queue is full,
+// which in turn backs up the backend's payload queue until the server starts shedding load.
+func (p FlushPool) Submit(batch *Batch) {
+	p.pending.Add(1)
+	p.queues[p.shard(batch.Warehouse, batch.Schema)] <- batch
+}
+
+// Wait blocks until every batch submitted so far has been written.
+func (p FlushPool) Wait() {
+	p.pending.Wait()
+}
+
+func (p FlushPool) shard(warehouse string, schema string) int {
+	h := fnv.New32a()
+	h.Write([]byte(warehouse))
+	h.Write([]byte{'/'})
+	h.Write([]byte(schema))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+const (
+	ColumnGeoPrefix  = "geo_"
+	ColumnGeoCountry = "geo_country"
+	ColumnGeoRegion  = "geo_region"
+)
+
+// The database is reloaded once the file has not changed for this long, so that a file still being written is not
+// loaded half way through.
+const geoReloadDelay = time.Second
+
+type geoRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+	region  string
+}
+
+// GeoDatabase maps IP addresses to countries and regions using ranges loaded from a local CSV file, with one range
+// per line:
+//  network,country,region
+//  1.0.0.0/24,AU,Queensland
+//  1.0.1.0-1.0.3.255,CN,Fujian
+// The network is either a CIDR block or an inclusive start-end range, the region is optional, and ranges must not
+// overlap. A header line is skipped. The file is loaded again whenever it changes, and the previous version is kept
+// if the new one cannot be read or is empty.
+type GeoDatabase struct {
+	path   string
+	ranges atomic.Value
+}
+
+// NewGeoDatabase loads the database file and starts watching it for changes.
+func NewGeoDatabase(path string) (*GeoDatabase, error) {
+	db := &GeoDatabase{path: path}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	if err := db.watch(); err != nil {
+		log.Printf("Cannot watch geo database %v for changes: %v\n", path, err)
+	}
+
+	return db, nil
+}
+
+// Lookup returns the country and region of the IP address, or empty strings if it is not in the database.
+func (db *GeoDatabase) Lookup(ip net.IP) (string, string) {
+	ranges := db.ranges.Load().([]geoRange)
+
+	ip = ip.To16()
+	if ip == nil {
+		return "", ""
+	}
+
+	// Find the last range starting at or before the IP.
+	i := sort.Search(len(ranges), func(i int) bool {
+		return bytes.Compare(ranges[i].start, ip) > 0
+	}) - 1
+
+	if i < 0 || bytes.Compare(ip, ranges[i].end) > 0 {
+		return "", ""
+	}
+
+	return ranges[i].country, ranges[i].region
+}
+
+func (db *GeoDatabase) load() error {
+	file, err := os.Open(db.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ranges, err := readGeoRanges(file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", db.path, err)
+	}
+	if len(ranges) == 0 {
+		return fmt.Errorf("%v has no ranges", db.path)
+	}
+
+	db.ranges.Store(ranges)
+	log.Printf("Loaded %v ranges from geo database %v\n", len(ranges), db.path)
+	return nil
+}
+
+// watch reloads the database when the file changes, once it has settled. The directory is watched rather than the
+// file itself, so that the file being replaced by a rename is noticed too.
+func (db *GeoDatabase) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(db.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	reload := func() {
+		if err := db.load(); err != nil {
+			log.Printf("Failed to reload geo database, keeping the previous version: %v\n", err)
+		}
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(db.path) || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(geoReloadDelay, reload)
+				} else {
+					timer.Reset(geoReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching geo database: %v\n", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func readGeoRanges(r io.Reader) ([]geoRange, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	var ranges []geoRange
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %v: expected at least a network and a country", line)
+		}
+
+		start, end, err := parseIpRange(strings.TrimSpace(record[0]))
+		if err != nil {
+			if line == 1 {
+				// Header line.
+				continue
+			}
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+
+		geo := geoRange{start: start, end: end, country: strings.TrimSpace(record[1])}
+		if len(record) > 2 {
+			geo.region = strings.TrimSpace(record[2])
+		}
+		ranges = append(ranges, geo)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	// Lookups find the range starting closest before an IP, which is only the right one if no ranges overlap.
+	for i := 1; i < len(ranges); i++ {
+		if bytes.Compare(ranges[i].start, ranges[i-1].end) <= 0 {
+			return nil, fmt.Errorf("ranges %v-%v and %v-%v overlap", ranges[i-1].start, ranges[i-1].end, ranges[i].start, ranges[i].end)
+		}
+	}
+
+	return ranges, nil
+}
+
+// parseIpRange parses a CIDR block or a start-end range into its first and last addresses, in 16 byte form.
+func parseIpRange(network string) (net.IP, net.IP, error) {
+	if strings.Contains(network, "/") {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start := ipNet.IP.To16()
+		end := make(net.IP, len(start))
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range start {
+			end[i] = start[i] | ^mask[i]
+		}
+		return start, end, nil
+	}
+
+	parts := strings.SplitN(network, "-", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("\"%v\" is neither a CIDR block nor a range", network)
+	}
+
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	end := net.ParseIP(strings.TrimSpace(parts[1]))
+	if start == nil || end == nil || bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, nil, fmt.Errorf("\"%v\" is not a valid range", network)
+	}
+
+	return start.To16(), end.To16(), nil
+}
+
+// GeoEnricher adds the country and region of the client IP as columns.
+type GeoEnricher struct {
+	db *GeoDatabase
+}
+
+func NewGeoEnricher() *GeoEnricher {
+	path := viper.GetString(ConfigGeoDatabaseFile)
+	if path == "" {
+		return &GeoEnricher{}
+	}
+
+	db, err := NewGeoDatabase(path)
+	checkError("failed to load geo database", err)
+
+	return &GeoEnricher{db: db}
+}
+
+func (e *GeoEnricher) Enrich(payload *Payload) bool {
+	if e.db == nil || payload.request == nil || payload.request.RemoteIp == nil {
+		return true
+	}
+
+	country, region := e.db.Lookup(payload.request.RemoteIp)
+	payload.SetServerValue(ColumnGeoCountry, nullIfEmpty(country))
+	payload.SetServerValue(ColumnGeoRegion, nullIfEmpty(region))
+	return true
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
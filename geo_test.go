@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGeoDatabase = `network,country,region
+1.0.0.0/24,AU,Queensland
+1.0.1.0-1.0.3.255,CN
+2001:db8::/32,ZZ,Documentation
+`
+
+func TestGeoDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geo")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "geo.csv")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testGeoDatabase), 0644))
+
+	db, err := NewGeoDatabase(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	lookup := func(ip string) []string {
+		country, region := db.Lookup(net.ParseIP(ip))
+		return []string{country, region}
+	}
+
+	assert.Equal(t, []string{"AU", "Queensland"}, lookup("1.0.0.255"))
+	assert.Equal(t, []string{"CN", ""}, lookup("1.0.2.1"))
+	assert.Equal(t, []string{"", ""}, lookup("1.0.4.0"))
+	assert.Equal(t, []string{"", ""}, lookup("0.255.255.255"))
+	assert.Equal(t, []string{"ZZ", "Documentation"}, lookup("2001:db8:1::1"))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("1.0.4.0/24,NZ\n"), 0644))
+	assert.Eventually(t, func() bool {
+		return lookup("1.0.4.1")[0] == "NZ"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A file emptied while it is rewritten is not loaded.
+	assert.Nil(t, ioutil.WriteFile(path, nil, 0644))
+	time.Sleep(geoReloadDelay + 500*time.Millisecond)
+	assert.Equal(t, []string{"NZ", ""}, lookup("1.0.4.1"))
+}
+
+func TestReadGeoRangesRejectsInvalidLines(t *testing.T) {
+	_, err := readGeoRanges(strings.NewReader("1.0.0.0/24,AU\nnot-a-network,US\n"))
+	assert.NotNil(t, err)
+}
+
+func TestReadGeoRangesRejectsOverlaps(t *testing.T) {
+	_, err := readGeoRanges(strings.NewReader("1.0.0.0/24,AU\n1.0.1.0-1.0.3.255,CN\n1.0.0.128-1.0.1.0,NZ\n"))
+	assert.EqualError(t, err, "ranges 1.0.0.0-1.0.0.255 and 1.0.0.128-1.0.1.0 overlap")
+
+	_, err = readGeoRanges(strings.NewReader("1.0.0.0/24,AU\n1.0.1.0/24,CN\n"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+)
+
+// BackendHealth describes whether a backend is keeping up with writing out what it is sent.
+type BackendHealth struct {
+	Healthy bool `json:"healthy"`
+	// Files that could not be uploaded yet, and are waiting on local disk to be retried.
+	SpooledFiles int   `json:"spooled_files,omitempty"`
+	SpooledBytes int64 `json:"spooled_bytes,omitempty"`
+	// Files that can never be uploaded, and were set aside to be looked into.
+	QuarantinedFiles int    `json:"quarantined_files,omitempty"`
+	LastError        string `json:"last_error,omitempty"`
+	LastErrorTime    int64  `json:"last_error_time,omitempty"`
+}
+
+// HealthCheck reports the health of every backend. The server keeps accepting payloads while a backend is unhealthy,
+// since failed writes are spooled, so it always answers 200 and leaves acting on "degraded" to monitoring.
+func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	health := make(map[string]BackendHealth)
+	for _, name := range backends.Names() {
+		health[name] = backends.Backend(name).Health()
+		if !health[name].Healthy {
+			status = "degraded"
+		}
+	}
+
+	writeJson(w, map[string]interface{}{
+		"status":   status,
+		"backends": health,
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Payloads with any invalid data key are rejected.
+	ValidationModeStrict = "strict"
+	// Invalid data keys are repaired where possible, and dropped where not, and the payload is accepted.
+	ValidationModeLenient = "lenient"
+)
+
+// Server column listing the changes the server made to a payload, such as lenient validation renaming keys, and
+// anything suspicious about it.
+const ColumnWarnings = "_uplink_warnings"
+
+const maxKeyLength = 128
+
+// RepairKeys renames the data keys of the payload that are not valid into ones that are, eg. userId becomes user_id,
+// and drops those that cannot be repaired, such as reserved words. Keys that are already valid are left alone and
+// win if a repaired key clashes with them. Every change is described in the warnings column.
+func RepairKeys(payload *Payload) {
+	var keys []string
+	for key := range payload.Data {
+		if ValidateKey(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := payload.Data[key]
+		delete(payload.Data, key)
+
+		repaired := NormalizeKey(key)
+		if message := ValidateKey(repaired); message != nil {
+			payload.AddWarning(fmt.Sprintf("dropped %v: %v", key, *message))
+			continue
+		}
+
+		if _, exists := payload.Data[repaired]; exists {
+			payload.AddWarning(fmt.Sprintf("dropped %v: %v is already set", key, repaired))
+			continue
+		}
+
+		payload.Data[repaired] = value
+		payload.AddWarning(fmt.Sprintf("renamed %v to %v", key, repaired))
+	}
+
+	if !payload.repaired {
+		payload.repaired = true
+		metricPayloadsRepaired.Add(1)
+	}
+}
+
+// NormalizeKey turns a key into snake case, strips the characters keys must not contain, and cuts it down to the
+// maximum key length. The result is not necessarily a valid key, for example if it is a reserved word.
+func NormalizeKey(key string) string {
+	runes := []rune(key)
+
+	var normalized []rune
+	for i, r := range runes {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			// Start a new word at the first capital of a word, or the last capital of an acronym, eg. HTTPStatus.
+			if i > 0 && (isLowerOrDigit(runes[i-1]) || (unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && isLowerOrDigit(runes[i+1]))) {
+				normalized = append(normalized, '_')
+			}
+			normalized = append(normalized, unicode.ToLower(r))
+		case isLowerOrDigit(r):
+			normalized = append(normalized, r)
+		case r == '_' || r == '-' || r == '.' || r == ' ':
+			normalized = append(normalized, '_')
+		}
+	}
+
+	var b strings.Builder
+	for _, r := range normalized {
+		if r == '_' && (b.Len() == 0 || strings.HasSuffix(b.String(), "_")) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	// Keys must start with a letter.
+	result := strings.TrimLeft(b.String(), "_0123456789")
+	if len(result) > maxKeyLength {
+		result = result[:maxKeyLength]
+	}
+	return strings.TrimRight(result, "_")
+}
+
+func isLowerOrDigit(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	assert.Equal(t, "user_id", NormalizeKey("userId"))
+	assert.Equal(t, "user_id", NormalizeKey("UserID"))
+	assert.Equal(t, "http_status_code", NormalizeKey("HTTPStatusCode"))
+	assert.Equal(t, "page_view_count", NormalizeKey("page-view.count"))
+	assert.Equal(t, "price", NormalizeKey("price ($)"))
+	assert.Equal(t, "item2", NormalizeKey("_2item2_"))
+	assert.Equal(t, "event", NormalizeKey("Event"))
+	assert.Equal(t, "", NormalizeKey("$$$"))
+	assert.Len(t, NormalizeKey(strings.Repeat("a", 200)), 128)
+}
+
+func TestRepairKeys(t *testing.T) {
+	payload := &Payload{Data: map[string]interface{}{
+		"user_id":  1,
+		"userId":   2,
+		"pageName": "home",
+		"event":    "click",
+		"Event":    "click",
+		"$":        true,
+		"count":    3,
+	}}
+
+	RepairKeys(payload)
+
+	assert.Equal(t, map[string]interface{}{
+		"user_id":   1,
+		"page_name": "home",
+		"count":     3,
+	}, payload.Data)
+
+	warnings := payload.Server[ColumnWarnings].(string)
+	assert.Contains(t, warnings, "renamed pageName to page_name")
+	assert.Contains(t, warnings, "dropped userId: user_id is already set")
+	assert.Contains(t, warnings, "dropped Event: Data key \"event\" is a reserved word and must not be used")
+	assert.Contains(t, warnings, "dropped event: Data key \"event\" is a reserved word and must not be used")
+	assert.Contains(t, warnings, "dropped $: ")
+
+	valid := &Payload{Data: map[string]interface{}{"count": 3}}
+	RepairKeys(valid)
+	assert.Nil(t, valid.Server)
+}
+
+func TestValidatePayloadLenientMode(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	viper.Set(ConfigValidationMode, ValidationModeStrict)
+	viper.Set("Warehouses.legacy.ValidationMode", ValidationModeLenient)
+	LoadSettings()
+
+	payload := &Payload{Warehouse: "dev", Schema: "events", ClientTimestamp: 1, Data: map[string]interface{}{"userId": 1}}
+	assert.NotNil(t, ValidatePayload(payload))
+
+	payload.Warehouse = "legacy"
+	assert.Nil(t, ValidatePayload(payload))
+	assert.Equal(t, map[string]interface{}{"user_id": 1}, payload.Data)
+	assert.Equal(t, "renamed userId to user_id", payload.Value(ColumnWarnings))
+	assert.True(t, IsServerColumn(ColumnWarnings))
+}
@@ -1,148 +1,119 @@
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
 	"fmt"
 	"log"
 	"os"
-	"sort"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 type LocalFileBackend struct {
-	schemaHeadersMap map[string][]string
-	payloadStoreMap  map[string][]*Payload
+	bufferedBackend
 
-	payloadChannel chan *Payload
+	instanceId string
+	directory  string
 
-	entriesPerFile int
-	sweepInterval  int64
-}
-
-func NewLocalFileBackend() Backend {
-	return LocalFileBackend{
-		schemaHeadersMap: make(map[string][]string),
-		payloadStoreMap:  make(map[string][]*Payload),
-		payloadChannel:   make(chan *Payload),
-		entriesPerFile:   viper.GetInt(ConfigEntriesPerFile),
-		sweepInterval:    viper.GetInt64(ConfigSweepInterval),
-	}
-}
+	nullValue string
+	format    string
 
-func (b LocalFileBackend) Run() {
-	for {
-		select {
-		case payload := <-b.payloadChannel:
-			b.updateHeadersFromPayload(payload)
-			b.storePayload(payload)
-			b.writeFileIfNecessary(payload.Schema)
-		}
-	}
-}
+	// Incremented for every file written, so that files written within the same second get distinct names.
+	sequence *uint64
 
-func (b LocalFileBackend) GetPayloadChannel() chan<- *Payload {
-	return b.payloadChannel
+	spool UploadSpool
 }
 
-func (b LocalFileBackend) GetHeaders(schema string) []string {
-	headers, ok := b.schemaHeadersMap[schema]
-	if ok {
-		return headers
+func NewLocalFileBackend(config BackendConfig) Backend {
+	b := LocalFileBackend{
+		bufferedBackend: newBufferedBackend(config),
+		instanceId:      viper.GetString(ConfigInstanceId),
+		directory:       config.GetString(ConfigLocalFileDirectory),
+		nullValue:       config.GetString(ConfigNullValue),
+		format:          config.Format(ConfigLocalFileFormat),
+		sequence:        new(uint64),
 	}
 
-	headers = []string{}
-	b.schemaHeadersMap[schema] = headers
-	return headers
-}
-
-func (b LocalFileBackend) ClearHeaders(schema string) {
-	delete(b.schemaHeadersMap, schema)
-}
+	// Files that cannot be written are spooled, and written into the directory once it can be written to again.
+	b.spool = NewUploadSpool(
+		filepath.Join(config.GetString(ConfigLocalFileSpoolDirectory), config.Name),
+		time.Duration(config.GetInt(ConfigLocalFileRetryInitialMillis))*time.Millisecond,
+		time.Duration(config.GetInt(ConfigLocalFileRetryMaxMillis))*time.Millisecond,
+		b.store,
+	)
 
-func (b LocalFileBackend) SetHeaders(schema string, headers []string) {
-	b.schemaHeadersMap[schema] = headers
+	return b
 }
 
-func (b LocalFileBackend) updateHeadersFromPayload(payload *Payload) {
-	var keys []string
-	for key := range payload.Data {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-
-	oldKeys := b.GetHeaders(payload.Schema)
+func (b LocalFileBackend) Run() {
+	go b.spool.Run()
 
-	for _, newKey := range keys {
-		found := false
-		for _, oldKey := range oldKeys {
-			if oldKey == newKey {
-				found = true
-				break
-			}
-		}
-		if !found {
-			oldKeys = append(oldKeys, newKey)
-		}
-	}
+	b.runLoop(b.writeFile)
+}
 
-	b.SetHeaders(payload.Schema, oldKeys)
+// Health reports the backend as unhealthy while there are files waiting to be written.
+func (b LocalFileBackend) Health() BackendHealth {
+	return b.spool.Health()
 }
 
-func (b LocalFileBackend) storePayload(payload *Payload) {
-	payloads, ok := b.payloadStoreMap[payload.Schema]
-	if !ok {
-		payloads = []*Payload{}
-		b.payloadStoreMap[payload.Schema] = payloads
+func (b LocalFileBackend) writeFile(batch *Batch) {
+	request, data, err := b.encode(batch)
+	if err != nil {
+		log.Printf("Failed to encode %v payloads for warehouse: %v and schema: %v: %v\n", len(batch.Payloads), batch.Warehouse, batch.Schema, err)
+		metricFilesFailed.Add(1)
+		return
 	}
-	payloads = append(payloads, payload)
-	b.payloadStoreMap[payload.Schema] = payloads
-}
 
-func (b LocalFileBackend) convertPayloadToStringList(payload *Payload) []string {
-	keys := b.GetHeaders(payload.Schema)
+	// A full or read only disk must not take the whole server down with everything else it has buffered, nor lose
+	// the batch.
+	if err := b.store(request, data); err != nil {
+		log.Printf("Failed to write %v, spooling it: %v\n", request.Object, err)
+		metricFilesFailed.Add(1)
 
-	var stringList []string
-	stringList = append(stringList, payload.Id, payload.Source, fmt.Sprintf("%v", payload.ServerTimestamp), fmt.Sprintf("%v", payload.ClientTimestamp))
-	for _, key := range keys {
-		data, ok := payload.Data[key]
-		if !ok {
-			data = ""
+		if err := b.spool.Store(request, data, err); err != nil {
+			log.Printf("Failed to spool %v, its %v payloads are lost: %v\n", request.Object, len(batch.Payloads), err)
+			metricUploadsLost.Add(1)
 		}
-		stringList = append(stringList, fmt.Sprintf("%v", data))
 	}
-	return stringList
 }
 
-func (b LocalFileBackend) writeFileIfNecessary(schema string) {
-	payloads := b.payloadStoreMap[schema]
-
-	fmt.Printf("Payloads Length for Schema: %v is: %v\n", schema, len(payloads))
+// encode returns the contents of the file for a batch, along with its path relative to the directory.
+func (b LocalFileBackend) encode(batch *Batch) (UploadRequest, []byte, error) {
+	encoder := EncoderForSchema(batch.Warehouse, batch.Schema, b.format, b.nullValue)
 
-	if len(payloads) >= b.entriesPerFile {
-		fileName := fmt.Sprintf("%v-%v.csv", schema, time.Now().Unix())
+	sequence := atomic.AddUint64(b.sequence, 1)
+	fileName := fmt.Sprintf("%v-%v-%v%v-%06d.%v", batch.Schema, b.instanceId, partitionName(batch), time.Now().Unix(), sequence, encoder.FileExtension())
+	request := UploadRequest{
+		Object:      filepath.Join(batch.Warehouse, batch.Schema, fileName),
+		ContentType: encoder.ContentType(),
+	}
 
-		file, err := os.Create(fileName)
-		checkError("Cannot create file", err)
-		defer file.Close()
+	var buffer bytes.Buffer
+	writer := encoder.NewWriter(&buffer)
+	writer.WriteHeader(batch.Headers)
 
-		writer := csv.NewWriter(file)
-		defer writer.Flush()
-		writer.Comma = '|'
+	for _, payload := range batch.Payloads {
+		writer.WriteRecord(batch.Headers, payload)
+	}
 
-		headers := b.GetHeaders(schema)
-		headers = append([]string{"id", "source", "server_timestamp, client_timestamp"}, headers...)
-		writer.Write(headers)
+	if err := writer.Flush(); err != nil {
+		return request, nil, fmt.Errorf("cannot encode payloads: %v", err)
+	}
 
-		for _, payload := range payloads {
-			stringList := b.convertPayloadToStringList(payload)
-			writer.Write(stringList)
-		}
+	return request, buffer.Bytes(), nil
+}
 
-		b.ClearHeaders(schema)
-		delete(b.payloadStoreMap, schema)
+// store writes a file into the directory. Readers of the directory never see a partially written file.
+func (b LocalFileBackend) store(request UploadRequest, data []byte) error {
+	path := filepath.Join(b.directory, request.Object)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
 	}
+
+	return writeFileAtomically(path, data)
 }
 
 func checkError(message string, err error) {
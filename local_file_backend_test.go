@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalFileBackendWrite(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uplink-localfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	b := LocalFileBackend{directory: directory, instanceId: "abcd1234", nullValue: `\N`, format: FormatCsv, sequence: new(uint64)}
+
+	batch := &Batch{
+		Warehouse: "dev",
+		Schema:    "events",
+		Partition: Partition{Label: "2018-06-01T13"},
+		Headers:   []string{"key_one"},
+		Payloads: []*Payload{
+			{Id: "a", Source: "web", ServerTimestamp: 2000, ClientTimestamp: 1000, Data: map[string]interface{}{"key_one": "x"}},
+			{Id: "b", Source: "web", ServerTimestamp: 3000, ClientTimestamp: 2500, Data: map[string]interface{}{}},
+		},
+	}
+	failed := metricFilesFailed.Value()
+	b.writeFile(batch)
+	b.writeFile(batch)
+	assert.Equal(t, failed, metricFilesFailed.Value())
+
+	// Files go under warehouse/schema, with nothing left behind from writing them.
+	files, err := ioutil.ReadDir(filepath.Join(directory, "dev", "events"))
+	assert.Nil(t, err)
+	if assert.Len(t, files, 2) {
+		pattern := regexp.MustCompile(`^events-abcd1234-2018-06-01T13-\d+-00000[12]\.csv$`)
+		assert.Regexp(t, pattern, files[0].Name())
+		assert.Regexp(t, pattern, files[1].Name())
+		assert.NotEqual(t, files[0].Name(), files[1].Name())
+
+		contents, err := ioutil.ReadFile(filepath.Join(directory, "dev", "events", files[0].Name()))
+		assert.Nil(t, err)
+		assert.Equal(t, "id,source,server_timestamp,client_timestamp,key_one\na,web,2000,1000,x\nb,web,3000,2500,\\N\n", string(contents))
+	}
+}
+
+func TestLocalFileBackendWriteFailure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uplink-localfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	// The directory cannot be created inside a file, just as it cannot on a full or read only disk.
+	output := filepath.Join(directory, "output")
+	assert.Nil(t, ioutil.WriteFile(output, nil, 0644))
+
+	b := LocalFileBackend{directory: output, format: FormatCsv, sequence: new(uint64)}
+	b.spool = NewUploadSpool(filepath.Join(directory, "spool"), time.Millisecond, time.Millisecond, b.store)
+
+	batch := &Batch{Warehouse: "dev", Schema: "events", Headers: []string{}, Payloads: []*Payload{{Id: "a"}}}
+	failed := metricFilesFailed.Value()
+	b.writeFile(batch)
+	assert.Equal(t, failed+1, metricFilesFailed.Value())
+	assert.False(t, b.Health().Healthy)
+
+	// The batch is kept in the spool, and written once the directory can be written to.
+	names, err := b.spool.list()
+	assert.Nil(t, err)
+	assert.Len(t, names, 1)
+	assert.NotNil(t, b.spool.retry(names))
+
+	assert.Nil(t, os.Remove(output))
+	assert.Nil(t, b.spool.retry(names))
+
+	files, err := ioutil.ReadDir(filepath.Join(output, "dev", "events"))
+	assert.Nil(t, err)
+	if assert.Len(t, files, 1) {
+		contents, err := ioutil.ReadFile(filepath.Join(output, "dev", "events", files[0].Name()))
+		assert.Nil(t, err)
+		assert.Equal(t, "id,source,server_timestamp,client_timestamp\na,,0,0\n", string(contents))
+	}
+
+	names, err = b.spool.list()
+	assert.Nil(t, err)
+	assert.Empty(t, names)
+}
@@ -5,12 +5,17 @@ import (
 	"crypto/rand"
 	"encoding/base32"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"strings"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/mux"
 	"github.com/pborman/uuid"
 	"github.com/spf13/viper"
@@ -23,10 +28,47 @@ const (
 
 	ConfigEnvVarPrefix = "UPLINK"
 
+	ConfigFile = "ConfigFile"
+
 	ConfigInstanceId     = "InstanceId"
 	ConfigEntriesPerFile = "EntriesPerFile"
 	ConfigSweepInterval  = "SweepInterval"
 	ConfigBackend        = "Backend"
+	ConfigBackends       = "Backends"
+	ConfigBackendType    = "Type"
+	ConfigRoutes         = "Routes"
+	ConfigDefaultRoute   = "DefaultRoute"
+	ConfigNullValue      = "NullValue"
+	ConfigFormat         = "Format"
+	ConfigQueueSize      = "QueueSize"
+	ConfigEnqueueTimeout = "EnqueueTimeoutMillis"
+	ConfigRetryAfter     = "RetryAfter"
+	ConfigFlushWorkers   = "FlushWorkers"
+	ConfigFlushQueueSize = "FlushQueueSize"
+
+	ConfigMaxBytesPerFile  = "MaxBytesPerFile"
+	ConfigMaxBufferedBytes = "MaxBufferedBytes"
+
+	ConfigRotationInterval = "RotationInterval"
+	ConfigRotationClock    = "RotationClock"
+
+	ConfigConsoleMode       = "ConsoleMode"
+	ConfigConsoleColor      = "ConsoleColor"
+	ConfigConsoleWarehouses = "ConsoleWarehouses"
+	ConfigConsoleSchemas    = "ConsoleSchemas"
+
+	ConfigConsoleFormat   = "ConsoleFormat"
+	ConfigLocalFileFormat = "LocalFileFormat"
+	ConfigS3FileFormat    = "S3FileFormat"
+
+	ConfigLocalFileDirectory          = "LocalFileDirectory"
+	ConfigLocalFileSpoolDirectory     = "LocalFileSpoolDirectory"
+	ConfigLocalFileRetryInitialMillis = "LocalFileRetryInitialMillis"
+	ConfigLocalFileRetryMaxMillis     = "LocalFileRetryMaxMillis"
+
+	ConfigAdminListenAddress = "AdminListenAddress"
+	ConfigAdminToken         = "AdminToken"
+	ConfigTailBufferSize     = "TailBufferSize"
 
 	ConfigS3Endpoint        = "S3Endpoint"
 	ConfigS3AccessKeyId     = "S3AccessKeyId"
@@ -34,6 +76,64 @@ const (
 	ConfigS3UseSSL          = "S3UseSSL"
 	ConfigS3BucketName      = "S3BucketName"
 	ConfigS3Location        = "S3Location"
+	ConfigS3Prefix          = "S3Prefix"
+
+	ConfigS3Credentials          = "S3Credentials"
+	ConfigS3AccessKeyIdFile      = "S3AccessKeyIdFile"
+	ConfigS3SecretAccessKeyFile  = "S3SecretAccessKeyFile"
+	ConfigS3CredentialsFile      = "S3CredentialsFile"
+	ConfigS3CredentialsProfile   = "S3CredentialsProfile"
+	ConfigS3IamEndpoint          = "S3IamEndpoint"
+	ConfigS3StsEndpoint          = "S3StsEndpoint"
+	ConfigS3RoleArn              = "S3RoleArn"
+	ConfigS3RoleSessionName      = "S3RoleSessionName"
+	ConfigS3WebIdentityTokenFile = "S3WebIdentityTokenFile"
+
+	ConfigS3Encryption      = "S3Encryption"
+	ConfigS3KmsKeyId        = "S3KmsKeyId"
+	ConfigS3CustomerKey     = "S3CustomerKey"
+	ConfigS3CustomerKeyFile = "S3CustomerKeyFile"
+	ConfigS3StorageClass    = "S3StorageClass"
+
+	ConfigS3SpoolDirectory     = "S3SpoolDirectory"
+	ConfigS3RetryInitialMillis = "S3RetryInitialMillis"
+	ConfigS3RetryMaxMillis     = "S3RetryMaxMillis"
+
+	ConfigValidationMode = "ValidationMode"
+
+	ConfigClockSkewCorrection   = "ClockSkewCorrection"
+	ConfigMaxFutureMillis       = "MaxFutureMillis"
+	ConfigMaxPastMillis         = "MaxPastMillis"
+	ConfigTimestampBoundsAction = "TimestampBoundsAction"
+
+	ConfigNestedDataMode     = "NestedDataMode"
+	ConfigNestedDataMaxDepth = "NestedDataMaxDepth"
+
+	ConfigCaptureRemoteIp  = "CaptureRemoteIp"
+	ConfigCaptureUserAgent = "CaptureUserAgent"
+	ConfigCaptureHeaders   = "CaptureHeaders"
+	ConfigTrustedProxies   = "TrustedProxies"
+	ConfigIpAnonymization  = "IpAnonymization"
+	ConfigIpHashKey        = "IpHashKey"
+
+	ConfigUserAgentEnrichment = "UserAgentEnrichment"
+	ConfigDropBots            = "DropBots"
+
+	ConfigGeoDatabaseFile = "GeoDatabaseFile"
+
+	ConfigRedactionRules   = "RedactionRules"
+	ConfigRedactionHmacKey = "RedactionHmacKey"
+
+	ConfigSampleRate = "SampleRate"
+	ConfigDisable    = "Disable"
+
+	ConfigDeadLetterSink            = "DeadLetterSink"
+	ConfigDeadLetterDirectory       = "DeadLetterDirectory"
+	ConfigDeadLetterS3Prefix        = "DeadLetterS3Prefix"
+	ConfigDeadLetterSampleRate      = "DeadLetterSampleRate"
+	ConfigDeadLetterMaxBodyBytes    = "DeadLetterMaxBodyBytes"
+	ConfigDeadLetterMaxBytesPerHour = "DeadLetterMaxBytesPerHour"
+	ConfigDeadLetterRawBodies       = "DeadLetterRawBodies"
 )
 
 type Payload struct {
@@ -43,16 +143,87 @@ type Payload struct {
 	Schema          string                 `json:"schema"`
 	ClientTimestamp int64                  `json:"client_timestamp"`
 	ServerTimestamp int64                  `json:"server_timestamp"`
+	SentAt          int64                  `json:"sent_at,omitempty"`
 	Data            map[string]interface{} `json:"data"`
+
+	// Columns added by the server, such as request metadata. Their names are reserved, so they never clash with
+	// the keys in Data.
+	Server map[string]interface{} `json:"server,omitempty"`
+
+	request *RequestInfo
+	// Set on payloads that the sampling and redaction enrichers have been through already, such as ones read back
+	// from files uplink wrote.
+	enriched bool
+	// Set once RepairKeys has changed the payload, so it is only counted once.
+	repaired bool
+}
+
+// SetServerValue sets the value of a server added column.
+func (p *Payload) SetServerValue(key string, value interface{}) {
+	if p.Server == nil {
+		p.Server = make(map[string]interface{})
+	}
+	p.Server[key] = value
+}
+
+// AddWarning appends to the warnings column of the payload.
+func (p *Payload) AddWarning(warning string) {
+	if warnings, ok := p.Server[ColumnWarnings].(string); ok && warnings != "" {
+		warning = warnings + "; " + warning
+	}
+	p.SetServerValue(ColumnWarnings, warning)
+}
+
+// Value returns the value of a server added or data column.
+func (p *Payload) Value(key string) interface{} {
+	if value, ok := p.Server[key]; ok {
+		return value
+	}
+	return p.Data[key]
 }
 
-var backend Backend
+var backends *BackendRouter
+var requestMetadata *RequestMetadata
+var enrichers []Enricher
+var tail *TailBroadcaster
+var deadLetters *DeadLetterQueue
 
 func setupConfig() {
 	viper.SetDefault(ConfigInstanceId, NewInstanceId())
 	viper.SetDefault(ConfigEntriesPerFile, 1000)
 	viper.SetDefault(ConfigSweepInterval, 60)
 	viper.SetDefault(ConfigBackend, BackendConsole)
+	viper.SetDefault(ConfigDefaultRoute, DefaultBackendName)
+	viper.SetDefault(ConfigNullValue, "\\N")
+	viper.SetDefault(ConfigQueueSize, 10000)
+	viper.SetDefault(ConfigEnqueueTimeout, 0)
+	viper.SetDefault(ConfigRetryAfter, 1)
+	viper.SetDefault(ConfigFlushWorkers, 4)
+	viper.SetDefault(ConfigFlushQueueSize, 8)
+
+	viper.SetDefault(ConfigMaxBytesPerFile, 64*1024*1024)
+	viper.SetDefault(ConfigMaxBufferedBytes, 512*1024*1024)
+	viper.SetDefault(ConfigRotationInterval, "")
+	viper.SetDefault(ConfigRotationClock, RotationClockServer)
+	viper.SetDefault(ConfigFormat, FormatPipe)
+
+	viper.SetDefault(ConfigConsoleMode, ConsoleModePretty)
+	viper.SetDefault(ConfigConsoleColor, true)
+	viper.SetDefault(ConfigConsoleWarehouses, []string{})
+	viper.SetDefault(ConfigConsoleSchemas, []string{})
+
+	viper.SetDefault(ConfigConsoleFormat, "")
+	viper.SetDefault(ConfigLocalFileFormat, "")
+	viper.SetDefault(ConfigS3FileFormat, "")
+
+	viper.SetDefault(ConfigLocalFileDirectory, ".")
+	viper.SetDefault(ConfigLocalFileSpoolDirectory, "spool")
+	viper.SetDefault(ConfigLocalFileRetryInitialMillis, 1000)
+	viper.SetDefault(ConfigLocalFileRetryMaxMillis, 5*60*1000)
+
+	viper.SetDefault(ConfigAdminListenAddress, "")
+	viper.SetDefault(ConfigAdminToken, "")
+	viper.SetDefault(ConfigTailBufferSize, 1000)
 
 	viper.SetDefault(ConfigS3Endpoint, "localhost:9000")
 	viper.SetDefault(ConfigS3AccessKeyId, "")
@@ -60,39 +231,139 @@ func setupConfig() {
 	viper.SetDefault(ConfigS3UseSSL, false)
 	viper.SetDefault(ConfigS3BucketName, "uplink")
 	viper.SetDefault(ConfigS3Location, "us-east-1")
+	viper.SetDefault(ConfigS3Prefix, "")
+	viper.SetDefault(ConfigS3Credentials, []string{S3CredentialsStatic})
+	viper.SetDefault(ConfigS3AccessKeyIdFile, "")
+	viper.SetDefault(ConfigS3SecretAccessKeyFile, "")
+	viper.SetDefault(ConfigS3CredentialsFile, "")
+	viper.SetDefault(ConfigS3CredentialsProfile, "")
+	viper.SetDefault(ConfigS3IamEndpoint, "")
+	viper.SetDefault(ConfigS3StsEndpoint, "https://sts.amazonaws.com")
+	viper.SetDefault(ConfigS3RoleArn, "")
+	viper.SetDefault(ConfigS3RoleSessionName, "uplink")
+	viper.SetDefault(ConfigS3WebIdentityTokenFile, "")
+	viper.SetDefault(ConfigS3Encryption, "")
+	viper.SetDefault(ConfigS3KmsKeyId, "")
+	viper.SetDefault(ConfigS3CustomerKey, "")
+	viper.SetDefault(ConfigS3CustomerKeyFile, "")
+	viper.SetDefault(ConfigS3StorageClass, "")
+	viper.SetDefault(ConfigS3SpoolDirectory, "spool")
+	viper.SetDefault(ConfigS3RetryInitialMillis, 1000)
+	viper.SetDefault(ConfigS3RetryMaxMillis, 5*60*1000)
+
+	viper.SetDefault(ConfigValidationMode, ValidationModeStrict)
+
+	viper.SetDefault(ConfigClockSkewCorrection, false)
+	viper.SetDefault(ConfigMaxFutureMillis, 0)
+	viper.SetDefault(ConfigMaxPastMillis, 0)
+	viper.SetDefault(ConfigTimestampBoundsAction, TimestampBoundsFlag)
+
+	viper.SetDefault(ConfigNestedDataMode, NestedDataModeJson)
+	viper.SetDefault(ConfigNestedDataMaxDepth, 5)
+
+	viper.SetDefault(ConfigCaptureRemoteIp, false)
+	viper.SetDefault(ConfigCaptureUserAgent, false)
+	viper.SetDefault(ConfigCaptureHeaders, []string{})
+	viper.SetDefault(ConfigTrustedProxies, []string{})
+	viper.SetDefault(ConfigIpAnonymization, IpAnonymizationTruncate)
+	viper.SetDefault(ConfigIpHashKey, "")
+
+	viper.SetDefault(ConfigUserAgentEnrichment, false)
+	viper.SetDefault(ConfigDropBots, false)
+
+	viper.SetDefault(ConfigGeoDatabaseFile, "")
+
+	viper.SetDefault(ConfigRedactionHmacKey, "")
+
+	viper.SetDefault(ConfigSampleRate, 1.0)
+	viper.SetDefault(ConfigDisable, "")
+
+	viper.SetDefault(ConfigDeadLetterSink, "")
+	viper.SetDefault(ConfigDeadLetterDirectory, "deadletters")
+	viper.SetDefault(ConfigDeadLetterS3Prefix, "deadletters/")
+	viper.SetDefault(ConfigDeadLetterSampleRate, 1.0)
+	viper.SetDefault(ConfigDeadLetterMaxBodyBytes, 64*1024)
+	viper.SetDefault(ConfigDeadLetterMaxBytesPerHour, 100*1024*1024)
+	viper.SetDefault(ConfigDeadLetterRawBodies, false)
 
 	viper.SetEnvPrefix(ConfigEnvVarPrefix)
 	viper.AutomaticEnv()
+
+	if configFile := viper.GetString(ConfigFile); configFile != "" {
+		viper.SetConfigFile(configFile)
+		err := viper.ReadInConfig()
+		checkError("failed to read config file", err)
+	}
+
+	LoadSettings()
 }
 
-func setupBackend() Backend {
-	switch viper.GetString(ConfigBackend) {
-	case BackendConsole:
-		return NewConsoleBackend()
-	case BackendLocalFile:
-		return NewLocalFileBackend()
-	case BackendS3File:
-		return NewS3FileBackend()
-	default:
-		return nil
+// watchConfig reloads the config file whenever it changes. Settings that are looked up per payload, like SampleRate
+// and Disable, take effect straight away. Everything else is only read at startup.
+func watchConfig() {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		LoadSettings()
+		log.Printf("Reloaded config file: %v\n", e.Name)
+	})
+	viper.WatchConfig()
+}
+
+func setupBackends() *BackendRouter {
+	router, err := NewBackendRouter()
+	checkError("failed to set up backends", err)
+	return router
+}
+
+func setupEnrichers() []Enricher {
+	return []Enricher{
+		NewSampler(),
+		NewRedactor(),
+		requestMetadata,
+		NewUserAgentEnricher(),
+		NewGeoEnricher(),
 	}
 }
 
 func main() {
-	setupConfig()
+	os.Exit(RunCommand(os.Args[1:]))
+}
 
+// serve runs the server until it fails. The config must already have been loaded.
+func serve() {
 	log.Printf("Launching Uplink Server with instance ID: %v\n", viper.GetString(ConfigInstanceId))
-	log.Printf("Using Backend: %v\n", viper.GetString(ConfigBackend))
+	backends = setupBackends()
+	requestMetadata = NewRequestMetadata()
+	enrichers = setupEnrichers()
+	tail = NewTailBroadcaster(viper.GetInt(ConfigTailBufferSize))
 
-	backend = setupBackend()
+	var err error
+	deadLetters, err = NewDeadLetterQueue()
+	checkError("failed to set up dead letters", err)
 
 	// Start background goroutines.
-	go backend.Run()
+	backends.Run()
+
+	if deadLetters != nil {
+		go deadLetters.Run()
+	}
+
+	if address := viper.GetString(ConfigAdminListenAddress); address != "" {
+		go startAdminServer(address, viper.GetString(ConfigAdminToken))
+	}
+
+	// From here on, viper is only read when the config file is reloaded.
+	watchConfig()
 
 	// Start web server.
 	router := mux.NewRouter()
 	router.HandleFunc("/v0/log", ReceivePayload).Methods("POST")
 	router.HandleFunc("/v0/log", PreflightResponder).Methods("OPTIONS")
+	router.HandleFunc("/health", HealthCheck).Methods("GET")
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
 	log.Fatal(http.ListenAndServe(":8000", router))
 }
 
@@ -101,27 +372,69 @@ func PreflightResponder(w http.ResponseWriter, r *http.Request) {
 }
 
 func ReceivePayload(w http.ResponseWriter, r *http.Request) {
+	if IngestionPaused() {
+		w.Header().Set("Retry-After", CurrentSettings().GetString(ConfigRetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Ingestion is paused. Please retry later."))
+		metricPayloadsShed.Add(1)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Failed to read body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	var payload Payload
 
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	err = decoder.Decode(&payload)
 	if err != nil {
 		log.Printf("Failed to decode body: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
+		deadLetters.Add(r, body, fmt.Sprintf("Failed to decode body: %v", err))
 		return
 	}
 
 	payload.ServerTimestamp = GetMillis()
 	payload.Id = uuid.NewRandom().String()
+	payload.Server = nil
+	payload.request = requestMetadata.NewRequestInfo(r)
+
+	if rejection, status := CheckPayload(&payload); rejection != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(*rejection))
+		metricPayloadsRejected.Add(1)
+		// Payloads for disabled schemas are turned away on purpose, so they are nothing to look into.
+		if status != http.StatusForbidden {
+			log.Println(*rejection)
+			deadLetters.Add(r, body, *rejection)
+		}
+		return
+	}
 
-	if validationResult := ValidatePayload(&payload); validationResult != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(*validationResult))
-		log.Println(*validationResult)
+	for _, enricher := range enrichers {
+		if !enricher.Enrich(&payload) {
+			metricPayloadsDropped.Add(1)
+			return
+		}
+	}
+
+	timeout := time.Duration(CurrentSettings().GetInt(ConfigEnqueueTimeout)) * time.Millisecond
+	if !EnqueuePayload(backends.Route(&payload).GetPayloadChannel(), &payload, timeout) {
+		w.Header().Set("Retry-After", CurrentSettings().GetString(ConfigRetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("The server is overloaded. Please retry later."))
+		metricPayloadsShed.Add(1)
 		return
 	}
 
-	channel := backend.GetPayloadChannel()
-	channel <- &payload
+	metricPayloadsAccepted.Add(1)
+	tail.Publish(&payload)
 }
 
 func newString(s string) *string {
@@ -136,6 +449,29 @@ const (
 var validWarehouse = regexp.MustCompile(warehouseRegex)
 var validSchema = regexp.MustCompile(schemaRegex)
 
+// CheckPayload runs every check a payload has to pass to be accepted, normalizing it on the way, so that the server,
+// replays and the validate command all accept the same payloads. It returns why the payload was rejected, if it was,
+// along with the HTTP status to answer with.
+func CheckPayload(payload *Payload) (*string, int) {
+	if validationResult := ValidatePayload(payload); validationResult != nil {
+		return validationResult, http.StatusBadRequest
+	}
+
+	if disabledResult := CheckSchemaEnabled(payload); disabledResult != nil {
+		return disabledResult, http.StatusForbidden
+	}
+
+	if timestampResult := CheckTimestamps(payload); timestampResult != nil {
+		return timestampResult, http.StatusBadRequest
+	}
+
+	if nestedResult := NormalizeNestedData(payload); nestedResult != nil {
+		return nestedResult, http.StatusBadRequest
+	}
+
+	return nil, http.StatusOK
+}
+
 func ValidatePayload(payload *Payload) *string {
 	if payload.ClientTimestamp <= 0 {
 		return newString("client_timestamp field must be greater than 0")
@@ -153,6 +489,10 @@ func ValidatePayload(payload *Payload) *string {
 		return newString("At least one data field must be provided in the payload")
 	}
 
+	if GetSchemaString(payload.Warehouse, payload.Schema, ConfigValidationMode) == ValidationModeLenient {
+		RepairKeys(payload)
+	}
+
 	for key, _ := range payload.Data {
 		if keyMsg := ValidateKey(key); keyMsg != nil {
 			return keyMsg
@@ -164,7 +504,42 @@ func ValidatePayload(payload *Payload) *string {
 
 const keyRegexp = "^[a-z][0-9a-z_]*[a-z0-9]$"
 var validKey = regexp.MustCompile(keyRegexp)
-var forbiddenKeys = []string{"id", "server_timestamp", "client_timestamp", "source", "event"}
+var forbiddenKeys = []string{"id", "server_timestamp", "client_timestamp", "source", "event", ColumnWarnings}
+
+// The columns, and column prefixes, added by the enrichers and checks that are enabled, see ReserveServerColumns.
+var reservedKeys []string
+var forbiddenKeyPrefixes []string
+
+// ReserveServerColumns reserves the columns of the enrichers and checks the config enables, so that clients cannot
+// send keys that clash with them. Columns are only reserved while they are enabled, so that keys like remote_ip or
+// header_text that clients already send keep working until they are.
+func ReserveServerColumns() {
+	reservedKeys = nil
+	if viper.GetBool(ConfigCaptureRemoteIp) {
+		reservedKeys = append(reservedKeys, ColumnRemoteIp)
+	}
+	if viper.GetBool(ConfigCaptureUserAgent) {
+		reservedKeys = append(reservedKeys, ColumnUserAgent)
+	}
+	// Clock skew correction can be switched on for a single warehouse or schema.
+	for _, key := range schemaSettingKeys(ConfigClockSkewCorrection) {
+		if viper.GetBool(key) {
+			reservedKeys = append(reservedKeys, ColumnClockSkew, ColumnAdjustedTimestamp)
+			break
+		}
+	}
+
+	forbiddenKeyPrefixes = nil
+	if len(GetStringList(ConfigCaptureHeaders)) > 0 {
+		forbiddenKeyPrefixes = append(forbiddenKeyPrefixes, ColumnHeaderPrefix)
+	}
+	if viper.GetBool(ConfigUserAgentEnrichment) {
+		forbiddenKeyPrefixes = append(forbiddenKeyPrefixes, ColumnUserAgentPrefix)
+	}
+	if viper.GetString(ConfigGeoDatabaseFile) != "" {
+		forbiddenKeyPrefixes = append(forbiddenKeyPrefixes, ColumnGeoPrefix)
+	}
+}
 
 func ValidateKey(key string) *string {
 	if !validKey.MatchString(key) {
@@ -177,16 +552,66 @@ func ValidateKey(key string) *string {
 		}
 	}
 
-	if len(key) < 2 && len(key) > 128 {
-		return newString(fmt.Sprintf("Data key \"%v\" is too long. It must be less than 128 characters"))
+	for _, value := range reservedKeys {
+		if value == key {
+			return newString(fmt.Sprintf("Data key \"%v\" is a reserved word and must not be used", key))
+		}
+	}
+
+	for _, prefix := range forbiddenKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return newString(fmt.Sprintf("Data key \"%v\" starts with the reserved prefix \"%v\" and must not be used", key, prefix))
+		}
+	}
+
+	if len(key) > maxKeyLength {
+		return newString(fmt.Sprintf("Data key \"%v\" is too long. It must be less than 128 characters", key))
 	}
 
 	return nil
 }
 
+// IsServerColumn returns true if the column is one added by the server rather than sent by the client.
+func IsServerColumn(key string) bool {
+	for _, value := range forbiddenKeys {
+		if value == key {
+			return true
+		}
+	}
+
+	for _, value := range reservedKeys {
+		if value == key {
+			return true
+		}
+	}
+
+	for _, prefix := range forbiddenKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// An Enricher adds server columns to a valid payload before it is handed to the backend. It returns false if the
+// payload should be dropped instead.
+type Enricher interface {
+	Enrich(payload *Payload) bool
+}
+
 type Backend interface {
 	Run()
 	GetPayloadChannel() chan<- *Payload
+	// GetBufferStats describes the payloads the backend is holding on to, per warehouse and schema.
+	GetBufferStats() []BufferStats
+	// Flush starts writing out the buffered payloads for the warehouse and schema straight away, where an empty
+	// warehouse or schema matches all of them. It returns the number of files started.
+	Flush(warehouse string, schema string) int
+	// Health reports whether the backend is managing to write out what it is sent.
+	Health() BackendHealth
+	// Drain writes out every payload the backend has been sent so far, and waits until they have been written.
+	Drain()
 }
 
 var encoding = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769")
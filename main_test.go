@@ -4,6 +4,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,3 +16,31 @@ func TestNewInstanceId(t *testing.T) {
 		assert.False(t, strings.Contains(id, "/"))
 	}
 }
+
+func TestReserveServerColumns(t *testing.T) {
+	defer viper.Reset()
+	defer func() {
+		reservedKeys = nil
+		forbiddenKeyPrefixes = nil
+	}()
+	setupConfig()
+
+	ReserveServerColumns()
+	for _, key := range []string{"header_text", "ua_browser", "geo_country", "remote_ip", "user_agent", "clock_skew_millis", "adjusted_client_timestamp"} {
+		assert.Nil(t, ValidateKey(key), key)
+		assert.False(t, IsServerColumn(key), key)
+	}
+	assert.NotNil(t, ValidateKey(ColumnWarnings))
+
+	viper.Set(ConfigCaptureHeaders, "X-Request-Id")
+	viper.Set(ConfigUserAgentEnrichment, true)
+	viper.Set(ConfigGeoDatabaseFile, "ranges.csv")
+	viper.Set(ConfigCaptureRemoteIp, true)
+	viper.Set(ConfigCaptureUserAgent, true)
+	viper.Set("Warehouses.dev.Schemas.events.ClockSkewCorrection", true)
+	ReserveServerColumns()
+	for _, key := range []string{"header_text", "ua_browser", "geo_country", "remote_ip", "user_agent", "clock_skew_millis", "adjusted_client_timestamp"} {
+		assert.NotNil(t, ValidateKey(key), key)
+		assert.True(t, IsServerColumn(key), key)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Counters and gauges for monitoring, served as JSON on /debug/vars.
+var (
+	metricPayloadsAccepted = expvar.NewInt("payloads_accepted")
+	metricPayloadsRejected = expvar.NewInt("payloads_rejected")
+	metricPayloadsShed     = expvar.NewInt("payloads_shed")
+	metricPayloadsDropped  = expvar.NewInt("payloads_dropped")
+	metricPayloadsRepaired = expvar.NewInt("payloads_repaired")
+	metricBufferedBytes    = expvar.NewInt("buffered_bytes")
+
+	metricFilesFailed = expvar.NewInt("files_failed")
+
+	metricUploadsFailed  = expvar.NewInt("uploads_failed")
+	metricUploadsRetried = expvar.NewInt("uploads_retried")
+	metricUploadsLost    = expvar.NewInt("uploads_lost")
+
+	metricDeadLettersWritten = expvar.NewInt("dead_letters_written")
+	metricDeadLettersSkipped = expvar.NewInt("dead_letters_skipped")
+)
+
+func init() {
+	expvar.Publish("queue_depth", expvar.Func(func() interface{} {
+		return backendQueueMetric(func(channel chan<- *Payload) int { return len(channel) })
+	}))
+
+	expvar.Publish("queue_capacity", expvar.Func(func() interface{} {
+		return backendQueueMetric(func(channel chan<- *Payload) int { return cap(channel) })
+	}))
+}
+
+// backendQueueMetric returns the metric for the payload queue of each backend, by backend name.
+func backendQueueMetric(metric func(channel chan<- *Payload) int) map[string]int {
+	values := make(map[string]int)
+	if backends == nil {
+		return values
+	}
+
+	for _, name := range backends.Names() {
+		values[name] = metric(backends.Backend(name).GetPayloadChannel())
+	}
+	return values
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// Nested objects become parent_child columns, arrays are serialized as JSON.
+	NestedDataModeFlatten = "flatten"
+	// Nested objects and arrays are serialized as JSON strings.
+	NestedDataModeJson = "json"
+	// Payloads containing nested objects or arrays are rejected.
+	NestedDataModeReject = "reject"
+)
+
+// NormalizeNestedData rewrites any nested objects or arrays in the payload data according to the
+// NestedDataMode configured for its warehouse and schema, so that every remaining value is a scalar. In lenient
+// validation mode, flattened keys that are not valid are repaired the same way as the keys of the payload.
+func NormalizeNestedData(payload *Payload) *string {
+	mode := GetSchemaString(payload.Warehouse, payload.Schema, ConfigNestedDataMode)
+	maxDepth := GetSchemaInt(payload.Warehouse, payload.Schema, ConfigNestedDataMaxDepth)
+	lenient := GetSchemaString(payload.Warehouse, payload.Schema, ConfigValidationMode) == ValidationModeLenient
+
+	data := make(map[string]interface{}, len(payload.Data))
+	for key, value := range payload.Data {
+		if depth := nestingDepth(value); depth > maxDepth {
+			return newString(fmt.Sprintf("Data key \"%v\" is nested %v levels deep. Values must not be nested more than %v levels deep", key, depth, maxDepth))
+		}
+
+		switch mode {
+		case NestedDataModeFlatten:
+			if msg := flattenValue(data, key, value, lenient); msg != nil {
+				return msg
+			}
+		case NestedDataModeJson:
+			normalized, err := serializeNestedValue(value)
+			if err != nil {
+				return newString(fmt.Sprintf("Data key \"%v\" could not be serialized: %v", key, err))
+			}
+			data[key] = normalized
+		case NestedDataModeReject:
+			if isNestedValue(value) {
+				return newString(fmt.Sprintf("Data key \"%v\" contains a nested object or array, which is not accepted for schema \"%v\"", key, payload.Schema))
+			}
+			data[key] = value
+		default:
+			return newString(fmt.Sprintf("Unknown nested data mode \"%v\" configured for schema \"%v\"", mode, payload.Schema))
+		}
+	}
+
+	payload.Data = data
+	if mode == NestedDataModeFlatten && lenient {
+		RepairKeys(payload)
+	}
+	return nil
+}
+
+// flattenValue adds the value to data, with any nested objects turned into parent_child keys. Those keys are only
+// validated if keepInvalidKeys is false, since otherwise they are repaired afterwards.
+func flattenValue(data map[string]interface{}, key string, value interface{}, keepInvalidKeys bool) *string {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		if _, exists := data[key]; exists {
+			return newString(fmt.Sprintf("Data key \"%v\" is provided more than once after flattening nested objects", key))
+		}
+
+		normalized, err := serializeNestedValue(value)
+		if err != nil {
+			return newString(fmt.Sprintf("Data key \"%v\" could not be serialized: %v", key, err))
+		}
+		data[key] = normalized
+		return nil
+	}
+
+	for childKey, childValue := range object {
+		flatKey := key + "_" + childKey
+		if !keepInvalidKeys {
+			if keyMsg := ValidateKey(flatKey); keyMsg != nil {
+				return keyMsg
+			}
+		}
+
+		if msg := flattenValue(data, flatKey, childValue, keepInvalidKeys); msg != nil {
+			return msg
+		}
+	}
+
+	return nil
+}
+
+func serializeNestedValue(value interface{}) (interface{}, error) {
+	if !isNestedValue(value) {
+		return value, nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func isNestedValue(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// nestingDepth returns 0 for scalar values, and one more than the deepest child for objects and arrays.
+func nestingDepth(value interface{}) int {
+	deepest := 0
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			if depth := nestingDepth(child); depth > deepest {
+				deepest = depth
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if depth := nestingDepth(child); depth > deepest {
+				deepest = depth
+			}
+		}
+	default:
+		return 0
+	}
+
+	return deepest + 1
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNestedPayload() *Payload {
+	return &Payload{
+		Warehouse: "dev",
+		Schema:    "events",
+		Data: map[string]interface{}{
+			"event_key": "post_create",
+			"user": map[string]interface{}{
+				"id":   "abc",
+				"role": map[string]interface{}{"name": "admin"},
+			},
+			"tags": []interface{}{"a", "b"},
+		},
+	}
+}
+
+func TestNormalizeNestedData(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	viper.Set(ConfigNestedDataMaxDepth, 5)
+	LoadSettings()
+
+	t.Run("flatten", func(t *testing.T) {
+		viper.Set(ConfigNestedDataMode, NestedDataModeFlatten)
+		LoadSettings()
+		payload := newNestedPayload()
+		assert.Nil(t, NormalizeNestedData(payload))
+		assert.Equal(t, map[string]interface{}{
+			"event_key":      "post_create",
+			"user_id":        "abc",
+			"user_role_name": "admin",
+			"tags":           `["a","b"]`,
+		}, payload.Data)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		viper.Set(ConfigNestedDataMode, NestedDataModeJson)
+		LoadSettings()
+		payload := newNestedPayload()
+		assert.Nil(t, NormalizeNestedData(payload))
+		assert.Equal(t, `{"id":"abc","role":{"name":"admin"}}`, payload.Data["user"])
+		assert.Equal(t, `["a","b"]`, payload.Data["tags"])
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		viper.Set(ConfigNestedDataMode, NestedDataModeReject)
+		LoadSettings()
+		assert.NotNil(t, NormalizeNestedData(newNestedPayload()))
+	})
+
+	t.Run("max depth", func(t *testing.T) {
+		viper.Set(ConfigNestedDataMode, NestedDataModeJson)
+		viper.Set(ConfigNestedDataMaxDepth, 1)
+		LoadSettings()
+		assert.NotNil(t, NormalizeNestedData(newNestedPayload()))
+	})
+
+	t.Run("flattened key collision", func(t *testing.T) {
+		viper.Set(ConfigNestedDataMode, NestedDataModeFlatten)
+		viper.Set(ConfigNestedDataMaxDepth, 5)
+		LoadSettings()
+		payload := &Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{
+			"user_id": "abc",
+			"user":    map[string]interface{}{"id": "def"},
+		}}
+		assert.NotNil(t, NormalizeNestedData(payload))
+	})
+
+	t.Run("invalid flattened key", func(t *testing.T) {
+		viper.Set(ConfigNestedDataMode, NestedDataModeFlatten)
+		LoadSettings()
+		payload := &Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{
+			"user": map[string]interface{}{"Id": "def"},
+		}}
+		assert.NotNil(t, NormalizeNestedData(payload))
+	})
+}
+
+func TestNormalizeNestedDataRepairsFlattenedKeys(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	setupConfig()
+	viper.Set(ConfigNestedDataMode, NestedDataModeFlatten)
+	viper.Set(ConfigValidationMode, ValidationModeLenient)
+	LoadSettings()
+
+	repaired := metricPayloadsRepaired.Value()
+	payload := &Payload{Warehouse: "dev", Schema: "events", ClientTimestamp: 1, Data: map[string]interface{}{
+		"pageName":       "home",
+		"user":           map[string]interface{}{"firstName": "x", "lastName": "y"},
+		"user_last_name": "z",
+	}}
+	rejection, _ := CheckPayload(payload)
+	assert.Nil(t, rejection)
+
+	assert.Equal(t, map[string]interface{}{"page_name": "home", "user_first_name": "x", "user_last_name": "z"}, payload.Data)
+	warnings := payload.Value(ColumnWarnings).(string)
+	assert.Contains(t, warnings, "renamed pageName to page_name")
+	assert.Contains(t, warnings, "renamed user_firstName to user_first_name")
+	assert.Contains(t, warnings, "dropped user_lastName: user_last_name is already set")
+	assert.Equal(t, repaired+1, metricPayloadsRepaired.Value())
+}
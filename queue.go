@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+)
+
+// EnqueuePayload hands the payload to the backend, waiting at most timeout for space in its queue. It returns false
+// if the queue stayed full, in which case the payload has not been accepted.
+func EnqueuePayload(channel chan<- *Payload, payload *Payload, timeout time.Duration) bool {
+	select {
+	case channel <- payload:
+		return true
+	default:
+	}
+
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case channel <- payload:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueuePayload(t *testing.T) {
+	channel := make(chan *Payload, 1)
+
+	assert.True(t, EnqueuePayload(channel, &Payload{}, 0))
+	assert.False(t, EnqueuePayload(channel, &Payload{}, 0))
+	assert.False(t, EnqueuePayload(channel, &Payload{}, 10*time.Millisecond))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-channel
+	}()
+	assert.True(t, EnqueuePayload(channel, &Payload{}, time.Second))
+	assert.Len(t, channel, 1)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	RedactionDrop   = "drop"
+	RedactionRedact = "redact"
+	RedactionHmac   = "hmac"
+)
+
+// Patterns that can be referred to by name in redaction rules instead of writing out a regular expression.
+var builtinRedactionPatterns = map[string]string{
+	"email":       `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"ip":          `\b(?:\d{1,3}\.){3}\d{1,3}\b|\b(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}\b`,
+	"card_number": `\b(?:\d[ -]?){12,18}\d\b`,
+}
+
+// HMAC keys shorter than this are refused, both for redaction and for hashing IPs, since a weak key lets hashed
+// values be recovered by hashing guesses.
+const minHmacKeyLength = 32
+
+var metricRedactionRuleHits = expvar.NewMap("redaction_rule_hits")
+
+// RedactionRuleConfig is a rule as written in the RedactionRules list of the config file:
+//  RedactionRules:
+//    - Name: strip_emails
+//      Warehouse: "*"
+//      Schema: "events*"
+//      Drop: [password]
+//      Redact:
+//        - Field: "*"
+//          Pattern: email
+//      Hmac: [user_email]
+// Warehouse, schema and field names are matched as glob patterns. Redact patterns are either the name of a built
+// in pattern (email, ip, card_number) or a regular expression.
+type RedactionRuleConfig struct {
+	Name      string
+	Warehouse string
+	Schema    string
+	Drop      []string
+	Redact    []RedactionPatternConfig
+	Hmac      []string
+}
+
+type RedactionPatternConfig struct {
+	Field       string
+	Pattern     string
+	Replacement string
+}
+
+type redactionPattern struct {
+	field       string
+	name        string
+	regexp      *regexp.Regexp
+	replacement string
+}
+
+type redactionRule struct {
+	name      string
+	warehouse string
+	schema    string
+	drop      []string
+	redact    []redactionPattern
+	hmac      []string
+}
+
+// Redactor drops, redacts or hashes data fields according to the configured rules, before the payload reaches the
+// backend. Every field a rule changes is counted in the redaction_rule_hits metric.
+type Redactor struct {
+	rules   []redactionRule
+	hmacKey []byte
+}
+
+func NewRedactor() *Redactor {
+	redactor, err := newRedactor()
+	checkError("failed to set up redaction", err)
+	return redactor
+}
+
+// newRedactor reads the redaction rules and key from the config, and describes what is wrong with them if they
+// cannot be used.
+func newRedactor() (*Redactor, error) {
+	var configs []RedactionRuleConfig
+	if err := viper.UnmarshalKey(ConfigRedactionRules, &configs); err != nil {
+		return nil, fmt.Errorf("cannot read %v: %v", ConfigRedactionRules, err)
+	}
+
+	rules, err := newRedactionRules(configs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction rule %v", err)
+	}
+
+	hmacKey := []byte(viper.GetString(ConfigRedactionHmacKey))
+	if err := checkRedactionHmacKey(rules, hmacKey); err != nil {
+		return nil, fmt.Errorf("redaction rule %v", err)
+	}
+
+	return &Redactor{
+		rules:   rules,
+		hmacKey: hmacKey,
+	}, nil
+}
+
+// checkRedactionHmacKey makes sure the key is strong enough if any rule hashes fields. Without a key the hashes
+// would be plain SHA-256, and emails or user IDs could be recovered from them by hashing a list of candidates.
+func checkRedactionHmacKey(rules []redactionRule, hmacKey []byte) error {
+	for _, rule := range rules {
+		if len(rule.hmac) > 0 && len(hmacKey) < minHmacKeyLength {
+			return fmt.Errorf("%v hashes fields, but %v is shorter than %v bytes", rule.name, ConfigRedactionHmacKey, minHmacKeyLength)
+		}
+	}
+	return nil
+}
+
+func newRedactionRules(configs []RedactionRuleConfig) ([]redactionRule, error) {
+	var rules []redactionRule
+	for i, config := range configs {
+		rule := redactionRule{
+			name:      config.Name,
+			warehouse: defaultPattern(config.Warehouse),
+			schema:    defaultPattern(config.Schema),
+			drop:      config.Drop,
+			hmac:      config.Hmac,
+		}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule%v", i)
+		}
+
+		for _, patternConfig := range config.Redact {
+			expression, ok := builtinRedactionPatterns[patternConfig.Pattern]
+			if !ok {
+				expression = patternConfig.Pattern
+			}
+
+			compiled, err := regexp.Compile(expression)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", rule.name, err)
+			}
+
+			replacement := patternConfig.Replacement
+			if replacement == "" {
+				replacement = "[redacted]"
+			}
+
+			rule.redact = append(rule.redact, redactionPattern{
+				field:       defaultPattern(patternConfig.Field),
+				name:        patternConfig.Pattern,
+				regexp:      compiled,
+				replacement: replacement,
+			})
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *Redactor) Enrich(payload *Payload) bool {
+	for _, rule := range r.rules {
+		if !matchPattern(rule.warehouse, payload.Warehouse) || !matchPattern(rule.schema, payload.Schema) {
+			continue
+		}
+
+		for key := range payload.Data {
+			if matchAny(rule.drop, key) {
+				delete(payload.Data, key)
+				r.countHit(rule, RedactionDrop)
+			}
+		}
+
+		for _, pattern := range rule.redact {
+			for key, value := range payload.Data {
+				if !matchPattern(pattern.field, key) {
+					continue
+				}
+
+				text, ok := redactableText(value)
+				if !ok {
+					continue
+				}
+
+				redacted := pattern.redact(text)
+				if redacted != text {
+					payload.Data[key] = redacted
+					r.countHit(rule, RedactionRedact)
+				}
+			}
+		}
+
+		for key, value := range payload.Data {
+			if value != nil && matchAny(rule.hmac, key) {
+				payload.Data[key] = r.hash(value)
+				r.countHit(rule, RedactionHmac)
+			}
+		}
+	}
+
+	return true
+}
+
+// RedactBody applies the rules to the data of a request body, leaving the rest of it as it is. It returns false if
+// the body is not a JSON object, so the rules cannot be applied.
+func (r *Redactor) RedactBody(body []byte) ([]byte, bool) {
+	var fields map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil || fields == nil {
+		return nil, false
+	}
+
+	payload := Payload{}
+	payload.Warehouse, _ = fields["warehouse"].(string)
+	payload.Schema, _ = fields["schema"].(string)
+	payload.Data, _ = fields["data"].(map[string]interface{})
+	r.Enrich(&payload)
+
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	return redacted, true
+}
+
+func (r *Redactor) hash(value interface{}) string {
+	mac := hmac.New(sha256.New, r.hmacKey)
+	mac.Write([]byte(EncodeValue(value, "")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *Redactor) countHit(rule redactionRule, action string) {
+	metricRedactionRuleHits.Add(rule.name+"."+action, 1)
+}
+
+func (p redactionPattern) redact(text string) string {
+	return p.regexp.ReplaceAllStringFunc(text, func(match string) string {
+		if p.name == "card_number" && !luhnValid(match) {
+			return match
+		}
+		return p.replacement
+	})
+}
+
+// redactableText returns the text of values that patterns are applied to. Numbers are included, since card
+// numbers are often sent as them.
+func redactableText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case nil, bool:
+		return "", false
+	default:
+		return EncodeValue(value, ""), true
+	}
+}
+
+// luhnValid checks the card number checksum of the digits in s, to avoid redacting other long numbers.
+func luhnValid(s string) bool {
+	sum := 0
+	digits := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		digit, err := strconv.Atoi(string(s[i]))
+		if err != nil {
+			continue
+		}
+
+		if digits%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+
+		sum += digit
+		digits++
+	}
+	return digits > 0 && sum%10 == 0
+}
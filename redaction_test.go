@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	rules, err := newRedactionRules([]RedactionRuleConfig{
+		{
+			Warehouse: "dev",
+			Schema:    "events*",
+			Drop:      []string{"password"},
+			Redact: []RedactionPatternConfig{
+				{Field: "*", Pattern: "email"},
+				{Field: "card", Pattern: "card_number", Replacement: "XXXX"},
+			},
+			Hmac: []string{"user_*"},
+		},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	r := &Redactor{rules: rules, hmacKey: []byte("secret")}
+
+	payload := &Payload{Warehouse: "dev", Schema: "events_web", Data: map[string]interface{}{
+		"password": "hunter2",
+		"message":  "contact me at someone@example.com please",
+		"card":     json.Number("4111111111111111"),
+		"order":    "1234567890123",
+		"user_id":  "abc",
+		"nothing":  nil,
+	}}
+	assert.True(t, r.Enrich(payload))
+
+	assert.NotContains(t, payload.Data, "password")
+	assert.Equal(t, "contact me at [redacted] please", payload.Data["message"])
+	assert.Equal(t, "XXXX", payload.Data["card"])
+	assert.Equal(t, "1234567890123", payload.Data["order"])
+	assert.Len(t, payload.Data["user_id"], 64)
+	assert.NotEqual(t, "abc", payload.Data["user_id"])
+	assert.Nil(t, payload.Data["nothing"])
+
+	other := &Payload{Warehouse: "prod", Schema: "events", Data: map[string]interface{}{"password": "hunter2"}}
+	assert.True(t, r.Enrich(other))
+	assert.Equal(t, "hunter2", other.Data["password"])
+}
+
+func TestNewRedactionRulesRejectsInvalidPatterns(t *testing.T) {
+	_, err := newRedactionRules([]RedactionRuleConfig{{Redact: []RedactionPatternConfig{{Pattern: "("}}}})
+	assert.NotNil(t, err)
+}
+
+func TestCheckRedactionHmacKey(t *testing.T) {
+	rules, err := newRedactionRules([]RedactionRuleConfig{{Name: "hash_ids", Hmac: []string{"user_id"}}})
+	assert.Nil(t, err)
+
+	assert.EqualError(t, checkRedactionHmacKey(rules, nil), "hash_ids hashes fields, but RedactionHmacKey is shorter than 32 bytes")
+	assert.NotNil(t, checkRedactionHmacKey(rules, []byte("secret")))
+	assert.Nil(t, checkRedactionHmacKey(rules, []byte("0123456789abcdef0123456789abcdef")))
+
+	// Rules that do not hash anything need no key.
+	rules, err = newRedactionRules([]RedactionRuleConfig{{Drop: []string{"password"}}})
+	assert.Nil(t, err)
+	assert.Nil(t, checkRedactionHmacKey(rules, nil))
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/spf13/viper"
+)
+
+// ReplayOptions controls how historical payloads are turned back into payloads for a backend.
+type ReplayOptions struct {
+	// Keep the IDs of payloads that have one, instead of giving every payload a new ID.
+	KeepIds bool
+	// Warehouse and schema of the payloads in delimited files, which do not record them. When empty, they are taken
+	// from the directories the file is in, as laid out by the localfile backend.
+	Warehouse string
+	Schema    string
+	// Value standing for null in delimited files.
+	NullValue string
+	// Read the files as dead letters, replaying the request bodies in them.
+	DeadLetters bool
+}
+
+// ReplayResult counts what happened to the payloads of a replay.
+type ReplayResult struct {
+	Replayed int
+	Rejected int
+	Dropped  int
+}
+
+func runReplay(args []string) int {
+	flags, configFile := newFlagSet("replay")
+	backendName := flags.StringP("backend", "b", "", "Backend to write to, instead of the one each payload is routed to")
+	keepIds := flags.Bool("keep-ids", false, "Keep the IDs of payloads that have one, instead of assigning new ones")
+	rate := flags.Float64("rate", 0, "Maximum payloads per second to replay, or 0 for no limit")
+	warehouse := flags.String("warehouse", "", "Warehouse of the payloads in CSV files, if not the name of the grandparent directory")
+	schema := flags.String("schema", "", "Schema of the payloads in CSV files, if not the name of the parent directory")
+	deadLetters := flags.Bool("dead-letters", false, "Read the files as dead letters, and replay the request bodies in them")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: uplink replay [flags] <file>...")
+		fmt.Fprintln(os.Stderr, "Files ending in .csv or .tsv are read as files written by uplink, anything else as JSON payloads, one per line.")
+		fmt.Fprintln(os.Stderr, "Payloads written by uplink, which have an id or a server_timestamp, are not sampled or redacted again.")
+		fmt.Fprintln(os.Stderr, "With --dead-letters, files are read as dead letters, which can be edited to fix the payloads first.")
+		fmt.Fprintln(os.Stderr, "Use - as the file to read JSON payloads from standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitCodeForParseError(err)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	loadConfig(*configFile)
+
+	options := ReplayOptions{
+		KeepIds:     *keepIds,
+		Warehouse:   *warehouse,
+		Schema:      *schema,
+		NullValue:   viper.GetString(ConfigNullValue),
+		DeadLetters: *deadLetters,
+	}
+
+	route, drain, err := replayBackends(*backendName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	requestMetadata = NewRequestMetadata()
+	enrichers = setupEnrichers()
+
+	var limiter <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	var result ReplayResult
+	for _, path := range flags.Args() {
+		reject := func(message string) {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, message)
+			result.Rejected++
+		}
+
+		err := ReadReplayFile(path, options, reject, func(payload *Payload) {
+			message, accepted := ReplayPayload(payload)
+			if message != nil {
+				reject(fmt.Sprintf("rejected payload %v: %v", payload.Id, *message))
+				return
+			}
+
+			if !accepted {
+				result.Dropped++
+				return
+			}
+
+			if limiter != nil {
+				<-limiter
+			}
+			route(payload).GetPayloadChannel() <- payload
+			result.Replayed++
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			drain()
+			return 1
+		}
+	}
+
+	drain()
+
+	fmt.Printf("%v replayed, %v rejected, %v dropped\n", result.Replayed, result.Rejected, result.Dropped)
+	if result.Rejected > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayBackends starts the backends a replay writes to. It returns the function picking the backend for each
+// payload, and the function that waits for everything sent to the backends to be written.
+func replayBackends(name string) (func(payload *Payload) Backend, func(), error) {
+	if name == "" {
+		router, err := NewBackendRouter()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		router.Run()
+		drain := func() {
+			for _, name := range router.Names() {
+				router.Backend(name).Drain()
+			}
+		}
+		return router.Route, drain, nil
+	}
+
+	name = strings.ToLower(name)
+	for _, configured := range BackendNames() {
+		if configured != name {
+			continue
+		}
+
+		backend, err := NewBackend(NewBackendConfig(name))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		go backend.Run()
+		route := func(payload *Payload) Backend {
+			return backend
+		}
+		return route, backend.Drain, nil
+	}
+
+	return nil, nil, fmt.Errorf("backend \"%v\" is not configured", name)
+}
+
+// ReplayPayload validates and enriches a historical payload the same way the server does a new one. It returns
+// why the payload was rejected if it was, and false if an enricher dropped it. Payloads read back from files uplink
+// wrote are not sampled or redacted again, since that would drop more of them than the sample rate says, and hash
+// values that are hashes already.
+func ReplayPayload(payload *Payload) (*string, bool) {
+	if rejection, _ := CheckPayload(payload); rejection != nil {
+		return rejection, false
+	}
+
+	for _, enricher := range enrichers {
+		if payload.enriched && appliedBeforeWriting(enricher) {
+			continue
+		}
+		if !enricher.Enrich(payload) {
+			return nil, false
+		}
+	}
+
+	return nil, true
+}
+
+// appliedBeforeWriting reports whether every payload in the files uplink writes has been through the enricher.
+func appliedBeforeWriting(enricher Enricher) bool {
+	switch enricher.(type) {
+	case *Sampler, *Redactor:
+		return true
+	}
+	return false
+}
+
+// ReadReplayFile reads the payloads in the file, passing each of them to replay in order. Payloads keep their
+// client timestamp, and their server timestamp if the file has one, so they land in the same place as they would
+// have originally. Server columns in the file are kept as well, since there is no request to work them out from.
+// Lines that cannot be turned into a payload at all are passed to reject, if the file format allows carrying on
+// after them.
+func ReadReplayFile(path string, options ReplayOptions, reject func(message string), replay func(payload *Payload)) error {
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	switch extension := strings.ToLower(filepath.Ext(path)); {
+	case options.DeadLetters:
+		return readDeadLetterPayloads(input, options, reject, replay)
+	case extension == ".csv", extension == ".tsv":
+		if options.Schema == "" {
+			options.Schema = filepath.Base(filepath.Dir(path))
+		}
+		if options.Warehouse == "" {
+			options.Warehouse = filepath.Base(filepath.Dir(filepath.Dir(path)))
+		}
+		return readDelimitedPayloads(input, options, replay)
+	default:
+		return readJsonLinesPayloads(input, options, replay)
+	}
+}
+
+// readJsonLinesPayloads reads payloads in the format clients send them, which is also the format the jsonl output
+// format writes them in. Payloads with an id, a server timestamp or server columns were written by uplink, and are
+// marked as enriched already. Any other payload is a client's, which has no say in the server columns.
+func readJsonLinesPayloads(r io.Reader, options ReplayOptions, replay func(payload *Payload)) error {
+	reader := bufio.NewReader(r)
+	now := GetMillis()
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var payload Payload
+
+			decoder := json.NewDecoder(bytes.NewReader(trimmed))
+			decoder.UseNumber()
+			if err := decoder.Decode(&payload); err != nil {
+				return fmt.Errorf("line %v: %v", lineNumber, err)
+			}
+
+			if payload.Id != "" || payload.ServerTimestamp > 0 || payload.Server != nil {
+				payload.enriched = true
+			} else {
+				payload.Server = nil
+			}
+
+			prepareReplayPayload(&payload, options, now)
+			replay(&payload)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readDeadLetterPayloads reads the request bodies of dead letters as payloads, received at the time the dead letter
+// was. Bodies that are still not valid payloads are rejected. Bodies that were redacted are marked as enriched.
+func readDeadLetterPayloads(r io.Reader, options ReplayOptions, reject func(message string), replay func(payload *Payload)) error {
+	reader := bufio.NewReader(r)
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var letter DeadLetter
+			if err := json.Unmarshal(trimmed, &letter); err != nil {
+				return fmt.Errorf("line %v: %v", lineNumber, err)
+			}
+
+			var payload Payload
+
+			decoder := json.NewDecoder(strings.NewReader(letter.Body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&payload); err != nil {
+				reject(fmt.Sprintf("line %v: failed to decode body: %v", lineNumber, err))
+			} else {
+				payload.Id = ""
+				payload.ServerTimestamp = 0
+				payload.Server = nil
+				payload.enriched = letter.Redacted
+				prepareReplayPayload(&payload, options, letter.ReceivedAt)
+				replay(&payload)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readDelimitedPayloads reads a file written by uplink in one of the delimited formats. Every value is read back
+// as a string, since the files do not record the original types. The payloads are marked as enriched already.
+func readDelimitedPayloads(r io.Reader, options ReplayOptions, replay func(payload *Payload)) error {
+	reader := bufio.NewReader(r)
+
+	firstLine, err := reader.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+
+	csvReader := csv.NewReader(reader)
+	csvReader.Comma = detectDelimiter(firstLine)
+
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(header) < len(fixedColumns) {
+		return fmt.Errorf("header does not start with the columns: %v", strings.Join(fixedColumns, ", "))
+	}
+	for i, column := range fixedColumns {
+		if header[i] != column {
+			return fmt.Errorf("header does not start with the columns: %v", strings.Join(fixedColumns, ", "))
+		}
+	}
+
+	now := GetMillis()
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		payload := Payload{
+			Id:        record[0],
+			Warehouse: options.Warehouse,
+			Source:    record[1],
+			Schema:    options.Schema,
+			Data:      make(map[string]interface{}),
+			enriched:  true,
+		}
+
+		payload.ServerTimestamp, err = strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid server_timestamp \"%v\": %v", record[2], err)
+		}
+
+		payload.ClientTimestamp, err = strconv.ParseInt(record[3], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid client_timestamp \"%v\": %v", record[3], err)
+		}
+
+		for i := len(fixedColumns); i < len(header); i++ {
+			var value interface{} = record[i]
+			if record[i] == options.NullValue {
+				value = nil
+			}
+
+			if IsServerColumn(header[i]) {
+				payload.SetServerValue(header[i], value)
+			} else if value != nil {
+				payload.Data[header[i]] = value
+			}
+		}
+
+		prepareReplayPayload(&payload, options, now)
+		replay(&payload)
+	}
+}
+
+func prepareReplayPayload(payload *Payload, options ReplayOptions, now int64) {
+	if !options.KeepIds || payload.Id == "" {
+		payload.Id = uuid.NewRandom().String()
+	}
+
+	if payload.ServerTimestamp <= 0 {
+		payload.ServerTimestamp = now
+	}
+}
+
+// detectDelimiter picks the delimiter of the formats uplink writes that appears in the header line.
+func detectDelimiter(firstLine []byte) rune {
+	if i := bytes.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+
+	for _, delimiter := range []rune{'|', '\t'} {
+		if bytes.ContainsRune(firstLine, delimiter) {
+			return delimiter
+		}
+	}
+	return ','
+}
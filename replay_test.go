@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDelimitedPayloads(t *testing.T) {
+	defer func() { reservedKeys = nil }()
+	reservedKeys = []string{ColumnRemoteIp}
+
+	input := strings.Join([]string{
+		`id|source|server_timestamp|client_timestamp|remote_ip|name|score`,
+		`a1|web|2000|1000|10.0.0.0|first|\N`,
+		`a2|app|2001|1001|\N|second|12`,
+	}, "\n")
+
+	var payloads []*Payload
+	options := ReplayOptions{KeepIds: true, Warehouse: "dev", Schema: "events", NullValue: `\N`}
+	err := readDelimitedPayloads(strings.NewReader(input), options, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	if !assert.Nil(t, err) || !assert.Len(t, payloads, 2) {
+		return
+	}
+
+	assert.Equal(t, "a1", payloads[0].Id)
+	assert.Equal(t, "dev", payloads[0].Warehouse)
+	assert.Equal(t, "events", payloads[0].Schema)
+	assert.Equal(t, "web", payloads[0].Source)
+	assert.Equal(t, int64(2000), payloads[0].ServerTimestamp)
+	assert.Equal(t, int64(1000), payloads[0].ClientTimestamp)
+	assert.Equal(t, map[string]interface{}{"remote_ip": "10.0.0.0"}, payloads[0].Server)
+	assert.Equal(t, map[string]interface{}{"name": "first"}, payloads[0].Data)
+
+	assert.Nil(t, payloads[1].Value("remote_ip"))
+	assert.Equal(t, "12", payloads[1].Value("score"))
+}
+
+func TestReplayPayloadDoesNotEnrichWrittenPayloadsTwice(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	setupConfig()
+	viper.Set(ConfigRedactionHmacKey, "0123456789abcdef0123456789abcdef")
+	viper.Set(ConfigRedactionRules, []interface{}{
+		map[string]interface{}{"Name": "hash_ids", "Hmac": []interface{}{"user_id"}},
+	})
+	viper.Set(ConfigSampleRate, 0.5)
+	LoadSettings()
+
+	defer func(original []Enricher) { enrichers = original }(enrichers)
+	enrichers = []Enricher{NewSampler(), NewRedactor()}
+
+	hashed := strings.Repeat("ab", 32)
+	input := `id|source|server_timestamp|client_timestamp|user_id` + "\n"
+	for i := 0; i < 20; i++ {
+		input += fmt.Sprintf("a%v|source%v|2000|1000|%v\n", i, i, hashed)
+	}
+
+	var payloads []*Payload
+	options := ReplayOptions{Warehouse: "dev", Schema: "events", NullValue: `\N`}
+	err := readDelimitedPayloads(strings.NewReader(input), options, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	if !assert.Nil(t, err) || !assert.Len(t, payloads, 20) {
+		return
+	}
+
+	for _, payload := range payloads {
+		message, accepted := ReplayPayload(payload)
+		assert.Nil(t, message)
+		assert.True(t, accepted)
+		assert.Equal(t, hashed, payload.Data["user_id"])
+	}
+
+	sent := &Payload{Warehouse: "dev", Schema: "events", ClientTimestamp: 1000, ServerTimestamp: 2000, Data: map[string]interface{}{"user_id": "abc"}}
+	for i := 0; sent.Source == "" || SampleFraction("dev", "events", sent.Source) >= 0.5; i++ {
+		sent.Source = fmt.Sprintf("source%v", i)
+	}
+	message, accepted := ReplayPayload(sent)
+	assert.Nil(t, message)
+	assert.True(t, accepted)
+	assert.Len(t, sent.Data["user_id"], 64)
+	assert.NotEqual(t, "abc", sent.Data["user_id"])
+}
+
+func TestReplayPayloadKeepsClockSkewCorrection(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	setupConfig()
+	viper.Set(ConfigClockSkewCorrection, true)
+	viper.Set(ConfigMaxPastMillis, 60000)
+	viper.Set(ConfigTimestampBoundsAction, TimestampBoundsReject)
+	LoadSettings()
+
+	defer func() { reservedKeys = nil }()
+	ReserveServerColumns()
+
+	defer func(original []Enricher) { enrichers = original }(enrichers)
+	enrichers = nil
+
+	// The client's clock was an hour behind, so only the adjusted timestamp is within bounds.
+	input := strings.Join([]string{
+		`id|source|server_timestamp|client_timestamp|adjusted_client_timestamp|clock_skew_millis|name`,
+		`a1|web|7200000|3600000|7199000|-3599000|first`,
+	}, "\n")
+
+	var payloads []*Payload
+	err := readDelimitedPayloads(strings.NewReader(input), ReplayOptions{Warehouse: "dev", Schema: "events", NullValue: `\N`}, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	if !assert.Nil(t, err) || !assert.Len(t, payloads, 1) {
+		return
+	}
+
+	message, accepted := ReplayPayload(payloads[0])
+	assert.Nil(t, message)
+	assert.True(t, accepted)
+	assert.Equal(t, "-3599000", payloads[0].Value(ColumnClockSkew))
+	assert.Equal(t, int64(7199000), payloads[0].Value(ColumnAdjustedTimestamp))
+
+	policy := RotationPolicy{clock: RotationClockClient, interval: time.Hour}
+	assert.Equal(t, int64(3600000), policy.Partition(payloads[0]).Start)
+}
+
+func TestReadDelimitedPayloadsRejectsForeignFiles(t *testing.T) {
+	err := readDelimitedPayloads(strings.NewReader("name,score\na,1\n"), ReplayOptions{}, func(payload *Payload) {})
+	assert.NotNil(t, err)
+}
+
+func TestReadJsonLinesPayloads(t *testing.T) {
+	input := strings.Join([]string{
+		`{"id": "kept", "warehouse": "dev", "schema": "events", "client_timestamp": 1000, "server_timestamp": 2000, "data": {"name": "a"}}`,
+		``,
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1001, "data": {"name": "b"}}`,
+	}, "\n")
+
+	var payloads []*Payload
+	err := readJsonLinesPayloads(strings.NewReader(input), ReplayOptions{KeepIds: true}, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	if !assert.Nil(t, err) || !assert.Len(t, payloads, 2) {
+		return
+	}
+
+	assert.Equal(t, "kept", payloads[0].Id)
+	assert.Equal(t, int64(2000), payloads[0].ServerTimestamp)
+	assert.NotEmpty(t, payloads[1].Id)
+	assert.True(t, payloads[1].ServerTimestamp > 2000)
+
+	payloads = nil
+	err = readJsonLinesPayloads(strings.NewReader(input), ReplayOptions{}, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "kept", payloads[0].Id)
+
+	err = readJsonLinesPayloads(strings.NewReader("{}\nnot json\n"), ReplayOptions{}, func(payload *Payload) {})
+	assert.EqualError(t, err, "line 2: invalid character 'o' in literal null (expecting 'u')")
+}
+
+func TestReadJsonLinesPayloadsFromUplink(t *testing.T) {
+	input := strings.Join([]string{
+		`{"id": "written", "warehouse": "dev", "schema": "events", "client_timestamp": 1000, "server_timestamp": 2000, "server": {"remote_ip": "10.0.0.0"}, "data": {"user_id": "hash"}}`,
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1001, "server": {"remote_ip": "10.0.0.0"}, "data": {"user_id": "abc"}}`,
+		`{"warehouse": "dev", "schema": "events", "client_timestamp": 1002, "data": {"user_id": "abc"}}`,
+	}, "\n")
+
+	var payloads []*Payload
+	err := readJsonLinesPayloads(strings.NewReader(input), ReplayOptions{}, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	if !assert.Nil(t, err) || !assert.Len(t, payloads, 3) {
+		return
+	}
+
+	assert.True(t, payloads[0].enriched)
+	assert.Equal(t, "10.0.0.0", payloads[0].Value("remote_ip"))
+
+	// Server columns alone mark the payload as written by uplink too.
+	assert.True(t, payloads[1].enriched)
+	assert.Equal(t, "10.0.0.0", payloads[1].Value("remote_ip"))
+
+	assert.False(t, payloads[2].enriched)
+	assert.Nil(t, payloads[2].Server)
+}
+
+func TestDetectDelimiter(t *testing.T) {
+	assert.Equal(t, '|', detectDelimiter([]byte("id|source|a,b\n1,2,3")))
+	assert.Equal(t, '\t', detectDelimiter([]byte("id\tsource\n")))
+	assert.Equal(t, ',', detectDelimiter([]byte("id,source\n1|2")))
+}
+
+func TestBufferedBackendDrain(t *testing.T) {
+	var written []*Batch
+	b := bufferedBackend{
+		payloadChannel: make(chan *Payload, 10),
+		commandChannel: make(chan func(pool FlushPool)),
+		buffer:         NewPayloadBuffer(),
+		limits:         BufferLimits{EntriesPerFile: 100},
+		flushWorkers:   2,
+	}
+
+	go b.runLoop(func(batch *Batch) {
+		written = append(written, batch)
+	})
+
+	for i := 0; i < 5; i++ {
+		b.GetPayloadChannel() <- &Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{"key": i}}
+	}
+
+	b.Drain()
+	if assert.Len(t, written, 1) {
+		assert.Len(t, written[0].Payloads, 5)
+	}
+	assert.Empty(t, b.GetBufferStats())
+}
+
+func TestReadDeadLetterPayloads(t *testing.T) {
+	input := strings.Join([]string{
+		`{"received_at": 5000, "reason": "bad key", "body": "{\"warehouse\": \"dev\", \"schema\": \"events\", \"client_timestamp\": 1000, \"data\": {\"name\": \"a\"}}"}`,
+		`{"received_at": 6000, "reason": "bad json", "body": "{\"warehouse\": "}`,
+	}, "\n")
+
+	var payloads []*Payload
+	var rejected []string
+	err := readDeadLetterPayloads(strings.NewReader(input), ReplayOptions{}, func(message string) {
+		rejected = append(rejected, message)
+	}, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	assert.Nil(t, err)
+
+	if assert.Len(t, payloads, 1) {
+		assert.Equal(t, "dev", payloads[0].Warehouse)
+		assert.Equal(t, int64(5000), payloads[0].ServerTimestamp)
+		assert.Equal(t, int64(1000), payloads[0].ClientTimestamp)
+		assert.NotEmpty(t, payloads[0].Id)
+	}
+
+	if assert.Len(t, rejected, 1) {
+		assert.True(t, strings.HasPrefix(rejected[0], "line 2: failed to decode body"))
+	}
+}
+
+func TestReplayRedactedDeadLetters(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	setupConfig()
+	viper.Set(ConfigRedactionHmacKey, "0123456789abcdef0123456789abcdef")
+	viper.Set(ConfigRedactionRules, []interface{}{
+		map[string]interface{}{"Name": "hash_ids", "Hmac": []interface{}{"user_id"}},
+	})
+	LoadSettings()
+
+	defer func(original []Enricher) { enrichers = original }(enrichers)
+	enrichers = []Enricher{NewSampler(), NewRedactor()}
+
+	defer func(old *RequestMetadata) { requestMetadata = old }(requestMetadata)
+	requestMetadata = &RequestMetadata{}
+
+	q := &DeadLetterQueue{channel: make(chan DeadLetter, 2), sampleRate: 1, redactor: NewRedactor()}
+	r := httptest.NewRequest("POST", "/v0/log", nil)
+	q.Add(r, []byte(`{"warehouse": "dev", "schema": "events", "client_timestamp": 1000, "data": {"user_id": "abc"}}`), "overloaded")
+	q.rawBodies = true
+	q.redactor = nil
+	q.Add(r, []byte(`{"warehouse": "dev", "schema": "events", "client_timestamp": 1000, "data": {"user_id": "abc"}}`), "overloaded")
+
+	var input bytes.Buffer
+	var hashed string
+	for i := 0; i < 2; i++ {
+		letter := <-q.channel
+		if letter.Redacted {
+			var body Payload
+			assert.Nil(t, json.Unmarshal([]byte(letter.Body), &body))
+			hashed, _ = body.Data["user_id"].(string)
+		}
+		line, err := json.Marshal(letter)
+		assert.Nil(t, err)
+		input.Write(line)
+		input.WriteByte('\n')
+	}
+	if !assert.Len(t, hashed, 64) {
+		return
+	}
+
+	var payloads []*Payload
+	err := readDeadLetterPayloads(&input, ReplayOptions{}, func(message string) {
+		t.Error(message)
+	}, func(payload *Payload) {
+		payloads = append(payloads, payload)
+	})
+	if !assert.Nil(t, err) || !assert.Len(t, payloads, 2) {
+		return
+	}
+
+	for _, payload := range payloads {
+		message, accepted := ReplayPayload(payload)
+		assert.Nil(t, message)
+		assert.True(t, accepted)
+	}
+
+	// The redacted dead letter keeps its hash, which joins with the same value ingested normally, and the raw one is
+	// hashed the same way.
+	assert.Equal(t, hashed, payloads[0].Data["user_id"])
+	assert.Equal(t, hashed, payloads[1].Data["user_id"])
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// The client IP is stored as received.
+	IpAnonymizationNone = "none"
+	// The last octet of IPv4 addresses and the last 80 bits of IPv6 addresses are zeroed.
+	IpAnonymizationTruncate = "truncate"
+	// The client IP is replaced with a keyed hash of itself.
+	IpAnonymizationHash = "hash"
+)
+
+const (
+	ColumnRemoteIp     = "remote_ip"
+	ColumnUserAgent    = "user_agent"
+	ColumnHeaderPrefix = "header_"
+)
+
+// RequestInfo holds what the server knows about the HTTP request a payload arrived in. It is kept with the payload
+// for enrichment, but is never written out itself.
+type RequestInfo struct {
+	// The client's IP address, after resolving X-Forwarded-For through trusted proxies. Never anonymized.
+	RemoteIp  net.IP
+	UserAgent string
+	Headers   http.Header
+}
+
+// RequestMetadata adds columns describing the HTTP request to payloads, as configured.
+type RequestMetadata struct {
+	captureRemoteIp  bool
+	captureUserAgent bool
+	captureHeaders   []string
+	trustedProxies   []*net.IPNet
+	ipAnonymization  string
+	ipHashKey        []byte
+}
+
+func NewRequestMetadata() *RequestMetadata {
+	m := &RequestMetadata{
+		captureRemoteIp:  viper.GetBool(ConfigCaptureRemoteIp),
+		captureUserAgent: viper.GetBool(ConfigCaptureUserAgent),
+		captureHeaders:   GetStringList(ConfigCaptureHeaders),
+		trustedProxies:   ParseNetworks(GetStringList(ConfigTrustedProxies)),
+		ipAnonymization:  viper.GetString(ConfigIpAnonymization),
+		ipHashKey:        []byte(viper.GetString(ConfigIpHashKey)),
+	}
+
+	checkError("invalid IP anonymization settings", checkIpHashKey(m.ipAnonymization, m.ipHashKey))
+
+	return m
+}
+
+// checkIpHashKey makes sure the key is strong enough if IPs are hashed, which dead letters do even when the remote IP
+// is not captured. There are few enough IPv4 addresses to hash them all, so without a key the hashes are reversible.
+func checkIpHashKey(ipAnonymization string, ipHashKey []byte) error {
+	if ipAnonymization == IpAnonymizationHash && len(ipHashKey) < minHmacKeyLength {
+		return fmt.Errorf("%v is %v, but %v is shorter than %v bytes", ConfigIpAnonymization, IpAnonymizationHash, ConfigIpHashKey, minHmacKeyLength)
+	}
+	return nil
+}
+
+// NewRequestInfo collects the request details from r, trusting X-Forwarded-For only as far back as the chain of
+// trusted proxies goes.
+func (m *RequestMetadata) NewRequestInfo(r *http.Request) *RequestInfo {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	remoteIp := net.ParseIP(host)
+
+	if remoteIp != nil && m.isTrustedProxy(remoteIp) {
+		forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if ip == nil {
+				break
+			}
+
+			remoteIp = ip
+			if !m.isTrustedProxy(ip) {
+				break
+			}
+		}
+	}
+
+	return &RequestInfo{
+		RemoteIp:  remoteIp,
+		UserAgent: r.UserAgent(),
+		Headers:   r.Header,
+	}
+}
+
+// Enrich adds the configured request metadata columns to the payload.
+func (m *RequestMetadata) Enrich(payload *Payload) bool {
+	info := payload.request
+	if info == nil {
+		return true
+	}
+
+	if m.captureRemoteIp && info.RemoteIp != nil {
+		payload.SetServerValue(ColumnRemoteIp, m.anonymizeIp(info.RemoteIp))
+	}
+
+	if m.captureUserAgent {
+		payload.SetServerValue(ColumnUserAgent, info.UserAgent)
+	}
+
+	for _, header := range m.captureHeaders {
+		if value := info.Headers.Get(header); value != "" {
+			payload.SetServerValue(HeaderColumn(header), value)
+		}
+	}
+
+	return true
+}
+
+func (m *RequestMetadata) isTrustedProxy(ip net.IP) bool {
+	for _, network := range m.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RequestMetadata) anonymizeIp(ip net.IP) string {
+	switch m.ipAnonymization {
+	case IpAnonymizationTruncate:
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case IpAnonymizationHash:
+		mac := hmac.New(sha256.New, m.ipHashKey)
+		mac.Write([]byte(ip.String()))
+		return hex.EncodeToString(mac.Sum(nil))[:32]
+	default:
+		return ip.String()
+	}
+}
+
+// HeaderColumn returns the name of the column a captured request header is stored in, eg. X-Request-Id is stored
+// in header_x_request_id.
+func HeaderColumn(header string) string {
+	return ColumnHeaderPrefix + strings.Replace(strings.ToLower(header), "-", "_", -1)
+}
+
+// ParseNetworks parses a list of CIDR networks. Plain IP addresses are treated as networks of a single address.
+func ParseNetworks(networks []string) []*net.IPNet {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			log.Printf("Ignoring invalid network \"%v\": %v\n", network, err)
+			continue
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed
+}
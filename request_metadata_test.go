@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestMetadata(t *testing.T) {
+	m := &RequestMetadata{
+		captureRemoteIp:  true,
+		captureUserAgent: true,
+		captureHeaders:   []string{"X-Request-Id"},
+		trustedProxies:   ParseNetworks([]string{"10.0.0.0/8", "192.168.1.1"}),
+		ipAnonymization:  IpAnonymizationNone,
+	}
+
+	newRequest := func(remoteAddr string, forwardedFor string) *http.Request {
+		r, _ := http.NewRequest("POST", "/v0/log", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("User-Agent", "test-agent")
+		r.Header.Set("X-Request-Id", "abc")
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return r
+	}
+
+	t.Run("untrusted remote ignores forwarded for", func(t *testing.T) {
+		info := m.NewRequestInfo(newRequest("203.0.113.7:1234", "198.51.100.1"))
+		assert.Equal(t, "203.0.113.7", info.RemoteIp.String())
+	})
+
+	t.Run("trusted proxies are skipped", func(t *testing.T) {
+		info := m.NewRequestInfo(newRequest("10.1.2.3:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1"))
+		assert.Equal(t, "198.51.100.1", info.RemoteIp.String())
+	})
+
+	t.Run("columns", func(t *testing.T) {
+		payload := &Payload{request: m.NewRequestInfo(newRequest("203.0.113.7:1234", ""))}
+		assert.True(t, m.Enrich(payload))
+		assert.Equal(t, map[string]interface{}{
+			"remote_ip":           "203.0.113.7",
+			"user_agent":          "test-agent",
+			"header_x_request_id": "abc",
+		}, payload.Server)
+	})
+}
+
+func TestAnonymizeIp(t *testing.T) {
+	m := &RequestMetadata{ipAnonymization: IpAnonymizationTruncate}
+	assert.Equal(t, "203.0.113.0", m.anonymizeIp(ParseNetworks([]string{"203.0.113.7"})[0].IP))
+	assert.Equal(t, "2001:db8:85a3::", m.anonymizeIp(ParseNetworks([]string{"2001:db8:85a3::8a2e:370:7334"})[0].IP))
+
+	m = &RequestMetadata{ipAnonymization: IpAnonymizationHash, ipHashKey: []byte("0123456789abcdef0123456789abcdef")}
+	hashed := m.anonymizeIp(ParseNetworks([]string{"203.0.113.7"})[0].IP)
+	assert.Len(t, hashed, 32)
+	assert.Equal(t, hashed, m.anonymizeIp(ParseNetworks([]string{"203.0.113.7"})[0].IP))
+}
+
+func TestCheckIpHashKey(t *testing.T) {
+	assert.EqualError(t, checkIpHashKey(IpAnonymizationHash, nil), "IpAnonymization is hash, but IpHashKey is shorter than 32 bytes")
+	assert.NotNil(t, checkIpHashKey(IpAnonymizationHash, []byte("secret")))
+	assert.Nil(t, checkIpHashKey(IpAnonymizationHash, []byte("0123456789abcdef0123456789abcdef")))
+	assert.Nil(t, checkIpHashKey(IpAnonymizationTruncate, nil))
+}
+
+func TestMergeColumnsKeepsServerColumnsFirst(t *testing.T) {
+	columns := MergeColumns(nil, &Payload{Data: map[string]interface{}{"b_key": 1}})
+	columns = MergeColumns(columns, &Payload{
+		Server: map[string]interface{}{ColumnUserAgent: "ua", ColumnRemoteIp: "1.2.3.4"},
+		Data:   map[string]interface{}{"a_key": 1},
+	})
+	assert.Equal(t, []string{"remote_ip", "user_agent", "b_key", "a_key"}, columns)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	RotationMinute = "minute"
+	RotationHour   = "hour"
+	RotationDay    = "day"
+)
+
+const (
+	// Payloads are partitioned by the time the server received them.
+	RotationClockServer = "server"
+	// Payloads are partitioned by when they happened on the client, corrected for clock skew where it is known.
+	RotationClockClient = "client"
+)
+
+// A Partition is the window of time the payloads of a batch fall in. The zero Partition means the buffer is not
+// partitioned by time.
+type Partition struct {
+	// Start and end of the window, in milliseconds. The end is exclusive.
+	Start int64
+	End   int64
+	// Label identifying the window in file names, eg. 2018-06-01T13 for an hour.
+	Label string
+}
+
+// RotationPolicy decides which time partition each payload belongs to, so that every file holds payloads from one
+// wall clock minute, hour or day only.
+type RotationPolicy struct {
+	interval time.Duration
+	layout   string
+	clock    string
+}
+
+func NewRotationPolicy(config BackendConfig) RotationPolicy {
+	policy := RotationPolicy{clock: config.GetString(ConfigRotationClock)}
+
+	switch config.GetString(ConfigRotationInterval) {
+	case RotationMinute:
+		policy.interval, policy.layout = time.Minute, "2006-01-02T15-04"
+	case RotationHour:
+		policy.interval, policy.layout = time.Hour, "2006-01-02T15"
+	case RotationDay:
+		policy.interval, policy.layout = 24*time.Hour, "2006-01-02"
+	}
+
+	return policy
+}
+
+// Enabled returns true if files are rotated at time boundaries.
+func (p RotationPolicy) Enabled() bool {
+	return p.interval > 0
+}
+
+// Partition returns the time partition of the payload.
+func (p RotationPolicy) Partition(payload *Payload) Partition {
+	if !p.Enabled() {
+		return Partition{}
+	}
+
+	millis := payload.ServerTimestamp
+	if p.clock == RotationClockClient {
+		millis = payload.ClientTimestamp
+		if adjusted, ok := payload.Server[ColumnAdjustedTimestamp].(int64); ok {
+			millis = adjusted
+		}
+	}
+
+	// Windows are aligned in UTC, which truncating the absolute time gives.
+	start := time.Unix(0, millis*int64(time.Millisecond)).UTC().Truncate(p.interval)
+	return Partition{
+		Start: start.UnixNano() / int64(time.Millisecond),
+		End:   start.Add(p.interval).UnixNano() / int64(time.Millisecond),
+		Label: start.Format(p.layout),
+	}
+}
+
+// partitionName returns the part of a file name identifying the time partition of the batch, if it has one.
+func partitionName(batch *Batch) string {
+	if batch.Partition.Label == "" {
+		return ""
+	}
+	return batch.Partition.Label + "-"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func millisAt(value string) int64 {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func TestRotationPolicy(t *testing.T) {
+	defer viper.Reset()
+	viper.Set(ConfigRotationInterval, RotationHour)
+	viper.Set(ConfigRotationClock, RotationClockServer)
+
+	payload := &Payload{ServerTimestamp: millisAt("2018-06-01T13:59:59Z"), ClientTimestamp: millisAt("2018-06-01T11:30:00Z")}
+
+	partition := NewRotationPolicy(NewBackendConfig(DefaultBackendName)).Partition(payload)
+	assert.Equal(t, millisAt("2018-06-01T13:00:00Z"), partition.Start)
+	assert.Equal(t, millisAt("2018-06-01T14:00:00Z"), partition.End)
+	assert.Equal(t, "2018-06-01T13", partition.Label)
+
+	viper.Set(ConfigRotationClock, RotationClockClient)
+	viper.Set(ConfigRotationInterval, RotationDay)
+	partition = NewRotationPolicy(NewBackendConfig(DefaultBackendName)).Partition(payload)
+	assert.Equal(t, millisAt("2018-06-01T00:00:00Z"), partition.Start)
+	assert.Equal(t, "2018-06-01", partition.Label)
+
+	// The client timestamp corrected for clock skew is used when there is one.
+	viper.Set(ConfigRotationInterval, RotationMinute)
+	payload.SetServerValue(ColumnAdjustedTimestamp, millisAt("2018-06-01T13:59:30Z"))
+	partition = NewRotationPolicy(NewBackendConfig(DefaultBackendName)).Partition(payload)
+	assert.Equal(t, "2018-06-01T13-59", partition.Label)
+
+	viper.Set(ConfigRotationInterval, "")
+	policy := NewRotationPolicy(NewBackendConfig(DefaultBackendName))
+	assert.False(t, policy.Enabled())
+	assert.Equal(t, Partition{}, policy.Partition(payload))
+}
+
+func TestPayloadBufferPartitions(t *testing.T) {
+	buffer := NewPayloadBuffer()
+	first := Partition{Start: 1000, End: 2000, Label: "first"}
+	second := Partition{Start: 2000, End: 3000, Label: "second"}
+
+	buffer.Add(&Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{"key": 1}}, second)
+	buffer.Add(&Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{"key": 2}}, first)
+	buffer.Add(&Payload{Warehouse: "dev", Schema: "events", Data: map[string]interface{}{"key": 3}}, first)
+
+	stats := buffer.Stats()
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, "first", stats[0].Partition)
+		assert.Equal(t, 2, stats[0].Payloads)
+	}
+
+	assert.Empty(t, buffer.TakeEnded(1999))
+
+	ended := buffer.TakeEnded(2000)
+	if assert.Len(t, ended, 1) {
+		assert.Equal(t, first, ended[0].Partition)
+		assert.Len(t, ended[0].Payloads, 2)
+	}
+
+	ended = buffer.TakeEnded(5000)
+	if assert.Len(t, ended, 1) {
+		assert.Equal(t, second, ended[0].Partition)
+	}
+	assert.Equal(t, 0, buffer.Bytes())
+}
+
+func TestPartitionName(t *testing.T) {
+	assert.Equal(t, "", partitionName(&Batch{}))
+	assert.Equal(t, "2018-06-01T13-", partitionName(&Batch{Partition: Partition{Label: "2018-06-01T13"}}))
+}
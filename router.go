@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// RouteConfig is an entry in the Routes list of the config file, sending the matching warehouses and schemas to
+// the named backend. Routes are checked in order, and payloads that match none go to the DefaultRoute backend:
+//  Routes:
+//    - Warehouse: "team_a*"
+//      Backend: team_a
+//  DefaultRoute: default
+// Warehouse and schema are matched as glob patterns, and match everything when left out.
+type RouteConfig struct {
+	Warehouse string
+	Schema    string
+	Backend   string
+}
+
+// BackendRouter owns every configured backend, and picks the one each payload is sent to.
+type BackendRouter struct {
+	backends     map[string]Backend
+	routes       []RouteConfig
+	defaultRoute string
+}
+
+func NewBackendRouter() (*BackendRouter, error) {
+	router := &BackendRouter{
+		backends:     make(map[string]Backend),
+		defaultRoute: strings.ToLower(viper.GetString(ConfigDefaultRoute)),
+	}
+
+	if err := viper.UnmarshalKey(ConfigRoutes, &router.routes); err != nil {
+		return nil, fmt.Errorf("failed to read routes: %v", err)
+	}
+
+	for i := range router.routes {
+		router.routes[i].Warehouse = defaultPattern(router.routes[i].Warehouse)
+		router.routes[i].Schema = defaultPattern(router.routes[i].Schema)
+		router.routes[i].Backend = strings.ToLower(router.routes[i].Backend)
+	}
+
+	used := map[string]bool{router.defaultRoute: true}
+	for _, route := range router.routes {
+		used[route.Backend] = true
+	}
+
+	for _, name := range BackendNames() {
+		// The default backend is only created if something routes to it, so it does not have to be configured
+		// when named backends are used for everything.
+		if !used[name] {
+			continue
+		}
+
+		b, err := NewBackend(NewBackendConfig(name))
+		if err != nil {
+			return nil, err
+		}
+		router.backends[name] = b
+	}
+
+	for name := range used {
+		if _, ok := router.backends[name]; !ok {
+			return nil, fmt.Errorf("route to backend \"%v\", which is not configured", name)
+		}
+	}
+
+	return router, nil
+}
+
+// Run starts all the backends.
+func (r *BackendRouter) Run() {
+	for _, name := range r.Names() {
+		log.Printf("Starting backend: %v of type: %v\n", name, NewBackendConfig(name).Type())
+		go r.backends[name].Run()
+	}
+}
+
+// Route returns the backend the payload should be sent to.
+func (r *BackendRouter) Route(payload *Payload) Backend {
+	return r.backends[r.RouteName(payload.Warehouse, payload.Schema)]
+}
+
+// RouteName returns the name of the backend payloads for the warehouse and schema are sent to.
+func (r *BackendRouter) RouteName(warehouse string, schema string) string {
+	for _, route := range r.routes {
+		if matchPattern(route.Warehouse, warehouse) && matchPattern(route.Schema, schema) {
+			return route.Backend
+		}
+	}
+	return r.defaultRoute
+}
+
+// Backend returns the named backend, or nil if there is no such backend.
+func (r *BackendRouter) Backend(name string) Backend {
+	return r.backends[name]
+}
+
+// Names returns the names of the running backends, sorted.
+func (r *BackendRouter) Names() []string {
+	var names []string
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
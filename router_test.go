@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendRouter(t *testing.T) {
+	defer viper.Reset()
+	viper.Set(ConfigBackend, BackendConsole)
+	viper.Set(ConfigDefaultRoute, DefaultBackendName)
+	viper.Set(ConfigBackends, map[string]interface{}{
+		"team_a": map[string]interface{}{"Type": BackendLocalFile, "LocalFileDirectory": "/data/team_a", "Format": FormatJsonLines},
+	})
+	viper.Set(ConfigRoutes, []interface{}{
+		map[string]interface{}{"Warehouse": "team_a*", "Backend": "team_a"},
+		map[string]interface{}{"Warehouse": "shared", "Schema": "team_a_*", "Backend": "team_a"},
+	})
+
+	router, err := NewBackendRouter()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"default", "team_a"}, router.Names())
+	assert.Equal(t, "team_a", router.RouteName("team_a_prod", "events"))
+	assert.Equal(t, "team_a", router.RouteName("shared", "team_a_clicks"))
+	assert.Equal(t, "default", router.RouteName("shared", "events"))
+
+	config := NewBackendConfig("team_a")
+	assert.Equal(t, "/data/team_a", config.GetString(ConfigLocalFileDirectory))
+	assert.Equal(t, FormatJsonLines, config.Format(ConfigLocalFileFormat))
+	assert.Equal(t, BackendLocalFile, config.Type())
+}
+
+func TestBackendRouterRejectsUnknownBackends(t *testing.T) {
+	defer viper.Reset()
+	viper.Set(ConfigBackend, BackendConsole)
+	viper.Set(ConfigDefaultRoute, DefaultBackendName)
+	viper.Set(ConfigRoutes, []interface{}{
+		map[string]interface{}{"Warehouse": "*", "Backend": "missing"},
+	})
+
+	_, err := NewBackendRouter()
+	assert.NotNil(t, err)
+
+	viper.Set(ConfigRoutes, []interface{}{})
+	viper.Set(ConfigBackend, "nonsense")
+	_, err = NewBackendRouter()
+	assert.NotNil(t, err)
+}
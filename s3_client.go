@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/minio/minio-go/pkg/encrypt"
+)
+
+const (
+	// The S3AccessKeyId and S3SecretAccessKey settings, or the files named by S3AccessKeyIdFile and
+	// S3SecretAccessKeyFile.
+	S3CredentialsStatic = "static"
+	// The shared AWS credentials file, ~/.aws/credentials unless S3CredentialsFile is set.
+	S3CredentialsFile = "file"
+	// The AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or MINIO_ACCESS_KEY and MINIO_SECRET_KEY, environment variables.
+	S3CredentialsEnv = "env"
+	// The role of the EC2 instance or ECS task, from the metadata endpoint.
+	S3CredentialsIam = "iam"
+	// A role assumed through STS with a web identity token, such as the one EKS mounts into pods.
+	S3CredentialsWebIdentity = "webidentity"
+	// Requests are sent unsigned, for buckets that allow anonymous writes.
+	S3CredentialsAnonymous = "anonymous"
+)
+
+const (
+	// Objects are encrypted with keys managed by S3.
+	S3EncryptionS3 = "sse-s3"
+	// Objects are encrypted with the KMS key named by S3KmsKeyId, or the default key of the account if it is empty.
+	S3EncryptionKms = "sse-kms"
+	// Objects are encrypted with the base64 encoded 256 bit key in S3CustomerKey or S3CustomerKeyFile, which S3 does
+	// not keep, so the same key is needed to read them.
+	S3EncryptionCustomer = "sse-c"
+)
+
+// Credentials fetched from STS are renewed this long before they expire.
+const s3CredentialsExpiryWindow = time.Minute
+
+// NewS3Client creates a client for the S3 endpoint the backend config points at.
+func NewS3Client(config BackendConfig) (*minio.Client, error) {
+	creds, err := NewS3Credentials(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The region is left empty, so that the client looks up the location of the bucket.
+	client, err := minio.NewWithCredentials(config.GetString(ConfigS3Endpoint), creds, config.GetBool(ConfigS3UseSSL), "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create S3 client for backend \"%v\": %v", config.Name, err)
+	}
+	return client, nil
+}
+
+// NewS3Credentials returns the credentials chain of the backend config. The providers listed in S3Credentials are
+// tried in order every time the credentials need fetching, and the first one that has credentials is used. If none
+// of them has, requests fail with the reasons why, unless anonymous is listed, in which case they are sent unsigned.
+// For example, to use keys from the environment when they are set, and the role of the instance otherwise:
+//  S3Credentials: env,iam
+func NewS3Credentials(config BackendConfig) (*credentials.Credentials, error) {
+	chain := &credentialsChain{}
+
+	names := config.GetStringList(ConfigS3Credentials)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("backend \"%v\" has no %v, list %v to send requests unsigned", config.Name, ConfigS3Credentials, S3CredentialsAnonymous)
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+
+		var provider credentials.Provider
+		switch name {
+		case S3CredentialsStatic:
+			accessKeyId, err := readSecret(config, ConfigS3AccessKeyId, ConfigS3AccessKeyIdFile)
+			if err != nil {
+				return nil, err
+			}
+			secretAccessKey, err := readSecret(config, ConfigS3SecretAccessKey, ConfigS3SecretAccessKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			provider = &credentials.Static{Value: credentials.Value{
+				AccessKeyID:     accessKeyId,
+				SecretAccessKey: secretAccessKey,
+				SignerType:      credentials.SignatureV4,
+			}}
+		case S3CredentialsFile:
+			file := credentials.NewFileAWSCredentials(config.GetString(ConfigS3CredentialsFile), config.GetString(ConfigS3CredentialsProfile))
+			provider = credentialsProvider{file}
+		case S3CredentialsEnv:
+			chain.add("env (AWS)", &credentials.EnvAWS{})
+			provider = &credentials.EnvMinio{}
+			name = "env (MinIO)"
+		case S3CredentialsIam:
+			provider = credentialsProvider{credentials.NewIAM(config.GetString(ConfigS3IamEndpoint))}
+		case S3CredentialsWebIdentity:
+			webIdentity, err := newWebIdentityProvider(config)
+			if err != nil {
+				return nil, err
+			}
+			provider = webIdentity
+		case S3CredentialsAnonymous:
+			chain.anonymous = true
+			continue
+		default:
+			return nil, fmt.Errorf("backend \"%v\" has unknown %v \"%v\"", config.Name, ConfigS3Credentials, name)
+		}
+
+		chain.add(name, provider)
+	}
+
+	return credentials.New(chain), nil
+}
+
+// credentialsChain tries its providers in order, like the chain in minio-go. Unlike it, it does not silently fall
+// back to anonymous requests when none of them has credentials, which only shows up as access being denied, but
+// fails with what went wrong with each of them.
+type credentialsChain struct {
+	names     []string
+	providers []credentials.Provider
+	anonymous bool
+
+	current credentials.Provider
+}
+
+func (c *credentialsChain) add(name string, provider credentials.Provider) {
+	c.names = append(c.names, name)
+	c.providers = append(c.providers, provider)
+}
+
+func (c *credentialsChain) Retrieve() (credentials.Value, error) {
+	c.current = nil
+
+	var problems []string
+	for i, provider := range c.providers {
+		value, err := provider.Retrieve()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", c.names[i], err))
+			continue
+		}
+		if value.AccessKeyID == "" || value.SecretAccessKey == "" {
+			problems = append(problems, fmt.Sprintf("%v: no credentials", c.names[i]))
+			continue
+		}
+
+		c.current = provider
+		return value, nil
+	}
+
+	if c.anonymous {
+		return credentials.Value{SignerType: credentials.SignatureAnonymous}, nil
+	}
+
+	err := fmt.Errorf("no S3 credentials found (%v)", strings.Join(problems, "; "))
+	log.Println(err)
+	return credentials.Value{}, err
+}
+
+func (c *credentialsChain) IsExpired() bool {
+	if c.current == nil {
+		return true
+	}
+	return c.current.IsExpired()
+}
+
+// NewS3ObjectOptions returns the options every object uploaded to the bucket of the backend config is stored with,
+// such as its encryption. They are applied to each upload, including retried ones, so that keys never end up in the
+// upload spool.
+func NewS3ObjectOptions(config BackendConfig) (minio.PutObjectOptions, error) {
+	options := minio.PutObjectOptions{
+		StorageClass: config.GetString(ConfigS3StorageClass),
+	}
+
+	var err error
+	switch mode := strings.ToLower(config.GetString(ConfigS3Encryption)); mode {
+	case "":
+	case S3EncryptionS3:
+		options.ServerSideEncryption = encrypt.NewSSE()
+	case S3EncryptionKms:
+		options.ServerSideEncryption, err = encrypt.NewSSEKMS(config.GetString(ConfigS3KmsKeyId), nil)
+	case S3EncryptionCustomer:
+		if !config.GetBool(ConfigS3UseSSL) {
+			return options, fmt.Errorf("backend \"%v\" has %v encryption, which needs %v", config.Name, S3EncryptionCustomer, ConfigS3UseSSL)
+		}
+
+		var encoded string
+		encoded, err = readSecret(config, ConfigS3CustomerKey, ConfigS3CustomerKeyFile)
+		if err != nil {
+			return options, err
+		}
+
+		var key []byte
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return options, fmt.Errorf("backend \"%v\" has an %v that is not base64 encoded: %v", config.Name, ConfigS3CustomerKey, err)
+		}
+		options.ServerSideEncryption, err = encrypt.NewSSEC(key)
+	default:
+		return options, fmt.Errorf("backend \"%v\" has unknown %v \"%v\"", config.Name, ConfigS3Encryption, mode)
+	}
+
+	if err != nil {
+		return options, fmt.Errorf("backend \"%v\" has invalid %v settings: %v", config.Name, ConfigS3Encryption, err)
+	}
+
+	return options, nil
+}
+
+// readSecret returns the value of the setting, or the contents of the file the file setting names if it is set,
+// so that secrets do not need to be put in the config or the environment.
+func readSecret(config BackendConfig, key string, fileKey string) (string, error) {
+	path := config.GetString(fileKey)
+	if path == "" {
+		return config.GetString(key), nil
+	}
+
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %v of backend \"%v\": %v", fileKey, config.Name, err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// credentialsProvider lets the credentials made by the minio-go constructors, whose providers cannot be built
+// directly, take part in a chain.
+type credentialsProvider struct {
+	*credentials.Credentials
+}
+
+func (p credentialsProvider) Retrieve() (credentials.Value, error) {
+	return p.Get()
+}
+
+// webIdentityProvider assumes a role with STS in exchange for the web identity token in a file, which is read
+// again every time, since it is rotated. Unlike the one in minio-go, it names the role, which AWS requires.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      *http.Client
+	stsEndpoint string
+	roleArn     string
+	sessionName string
+	tokenFile   string
+}
+
+func newWebIdentityProvider(config BackendConfig) (*webIdentityProvider, error) {
+	p := &webIdentityProvider{
+		client:      &http.Client{Timeout: 30 * time.Second},
+		stsEndpoint: config.GetString(ConfigS3StsEndpoint),
+		roleArn:     config.GetString(ConfigS3RoleArn),
+		sessionName: config.GetString(ConfigS3RoleSessionName),
+		tokenFile:   config.GetString(ConfigS3WebIdentityTokenFile),
+	}
+
+	// The same environment variables as the AWS SDKs, which EKS sets for pods with a service account role.
+	if p.roleArn == "" {
+		p.roleArn = os.Getenv("AWS_ROLE_ARN")
+	}
+	if p.tokenFile == "" {
+		p.tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+
+	if p.roleArn == "" || p.tokenFile == "" {
+		return nil, fmt.Errorf("backend \"%v\" has %v credentials, but no %v or %v", config.Name, S3CredentialsWebIdentity, ConfigS3RoleArn, ConfigS3WebIdentityTokenFile)
+	}
+
+	return p, nil
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	values := url.Values{}
+	values.Set("Action", "AssumeRoleWithWebIdentity")
+	values.Set("Version", "2011-06-15")
+	values.Set("RoleArn", p.roleArn)
+	values.Set("RoleSessionName", p.sessionName)
+	values.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	response, err := p.client.PostForm(p.stsEndpoint, values)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("cannot assume role %v: %v", p.roleArn, response.Status)
+	}
+
+	var result credentials.AssumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return credentials.Value{}, err
+	}
+
+	assumed := result.Result.Credentials
+	p.SetExpiration(assumed.Expiration, s3CredentialsExpiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     assumed.AccessKey,
+		SecretAccessKey: assumed.SecretKey,
+		SessionToken:    assumed.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
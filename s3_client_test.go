@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/minio/minio-go/pkg/encrypt"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3CredentialsStatic(t *testing.T) {
+	defer viper.Reset()
+	setupConfig()
+
+	directory, err := ioutil.TempDir("", "uplink-credentials")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	secretFile := filepath.Join(directory, "secret")
+	assert.Nil(t, ioutil.WriteFile(secretFile, []byte("secret-from-file\n"), 0600))
+
+	viper.Set(ConfigS3AccessKeyId, "access")
+	viper.Set(ConfigS3SecretAccessKey, "ignored")
+	viper.Set(ConfigS3SecretAccessKeyFile, secretFile)
+
+	creds, err := NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	value, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "access", value.AccessKeyID)
+	assert.Equal(t, "secret-from-file", value.SecretAccessKey)
+
+	viper.Set(ConfigS3SecretAccessKeyFile, filepath.Join(directory, "missing"))
+	_, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.NotNil(t, err)
+
+	viper.Set(ConfigS3SecretAccessKeyFile, "")
+	viper.Set(ConfigS3Credentials, "static,unknown")
+	_, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.EqualError(t, err, "backend \"default\" has unknown S3Credentials \"unknown\"")
+}
+
+func TestS3CredentialsChain(t *testing.T) {
+	defer viper.Reset()
+	setupConfig()
+
+	defer os.Setenv("AWS_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID"))
+	defer os.Setenv("AWS_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "env-access")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	// Static credentials without keys are skipped in favour of the next provider.
+	viper.Set(ConfigS3Credentials, "static,env")
+	creds, err := NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	value, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "env-access", value.AccessKeyID)
+
+	viper.Set(ConfigS3AccessKeyId, "access")
+	viper.Set(ConfigS3SecretAccessKey, "secret")
+	creds, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	value, err = creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "access", value.AccessKeyID)
+
+	// Without any credentials, requests fail with the reason, rather than being sent unsigned.
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	viper.Set(ConfigS3AccessKeyId, "")
+	viper.Set(ConfigS3Credentials, "static,env,file")
+	viper.Set(ConfigS3CredentialsFile, "/nonexistent/credentials")
+	creds, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	_, err = creds.Get()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "static: no credentials")
+		assert.Contains(t, err.Error(), "env (AWS): no credentials")
+		assert.Contains(t, err.Error(), "file: open /nonexistent/credentials")
+	}
+
+	viper.Set(ConfigS3Credentials, "static,anonymous")
+	creds, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	value, err = creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, credentials.SignatureAnonymous, value.SignerType)
+
+	viper.Set(ConfigS3Credentials, []string{})
+	_, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.EqualError(t, err, "backend \"default\" has no S3Credentials, list anonymous to send requests unsigned")
+}
+
+func TestS3CredentialsWebIdentity(t *testing.T) {
+	defer viper.Reset()
+	setupConfig()
+
+	directory, err := ioutil.TempDir("", "uplink-credentials")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	tokenFile := filepath.Join(directory, "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("jwt"), 0600))
+
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "AssumeRoleWithWebIdentity", r.Form.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/uplink", r.Form.Get("RoleArn"))
+		assert.Equal(t, "uplink", r.Form.Get("RoleSessionName"))
+		assert.Equal(t, "jwt", r.Form.Get("WebIdentityToken"))
+
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>assumed-access</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+
+	viper.Set(ConfigS3Credentials, S3CredentialsWebIdentity)
+	viper.Set(ConfigS3StsEndpoint, sts.URL)
+	viper.Set(ConfigS3WebIdentityTokenFile, tokenFile)
+
+	defer os.Setenv("AWS_ROLE_ARN", os.Getenv("AWS_ROLE_ARN"))
+	os.Setenv("AWS_ROLE_ARN", "")
+	_, err = NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.NotNil(t, err)
+
+	viper.Set(ConfigS3RoleArn, "arn:aws:iam::123456789012:role/uplink")
+	creds, err := NewS3Credentials(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+
+	value, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "assumed-access", value.AccessKeyID)
+	assert.Equal(t, "assumed-secret", value.SecretAccessKey)
+	assert.Equal(t, "assumed-token", value.SessionToken)
+	assert.False(t, creds.IsExpired())
+
+	// A role that cannot be assumed is reported, not turned into anonymous requests.
+	os.Remove(tokenFile)
+	creds.Expire()
+	_, err = creds.Get()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "webidentity: open "+tokenFile)
+	}
+}
+
+func TestS3ObjectOptions(t *testing.T) {
+	defer viper.Reset()
+	setupConfig()
+
+	options, err := NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	assert.Nil(t, options.ServerSideEncryption)
+	assert.Equal(t, "", options.StorageClass)
+
+	viper.Set(ConfigS3StorageClass, "STANDARD_IA")
+	viper.Set(ConfigS3Encryption, S3EncryptionS3)
+	options, err = NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	assert.Equal(t, encrypt.S3, options.ServerSideEncryption.Type())
+	assert.Equal(t, "STANDARD_IA", options.StorageClass)
+
+	viper.Set(ConfigS3Encryption, S3EncryptionKms)
+	viper.Set(ConfigS3KmsKeyId, "alias/uplink")
+	options, err = NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	assert.Equal(t, encrypt.KMS, options.ServerSideEncryption.Type())
+	header := http.Header{}
+	options.ServerSideEncryption.Marshal(header)
+	assert.Equal(t, "alias/uplink", header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+
+	// Customer keys are only ever sent over TLS.
+	viper.Set(ConfigS3Encryption, S3EncryptionCustomer)
+	viper.Set(ConfigS3CustomerKey, "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	_, err = NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.NotNil(t, err)
+
+	viper.Set(ConfigS3UseSSL, true)
+	options, err = NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.Nil(t, err)
+	assert.Equal(t, encrypt.SSEC, options.ServerSideEncryption.Type())
+
+	viper.Set(ConfigS3CustomerKey, "c2hvcnQ=")
+	_, err = NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.NotNil(t, err)
+
+	viper.Set(ConfigS3Encryption, "rot13")
+	_, err = NewS3ObjectOptions(NewBackendConfig(DefaultBackendName))
+	assert.EqualError(t, err, "backend \"default\" has unknown S3Encryption \"rot13\"")
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"log"
-	"sort"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/minio/minio-go"
@@ -15,179 +16,174 @@ import (
 )
 
 type S3FileBackend struct {
+	bufferedBackend
+
 	instanceId string
 
-	entriesPerFile int
-	sweepInterval  int64
+	bucketName string
+	prefix     string
+
+	nullValue string
+	format    string
 
 	client *minio.Client
+	spool  UploadSpool
 
-	payloadChannel chan *Payload
+	// Encryption and storage class of uploaded objects.
+	objectOptions minio.PutObjectOptions
 
-	schemaHeadersMap map[string]map[string][]string
-	payloadStoreMap  map[string]map[string][]*Payload
+	// Incremented for every file written, so that files written within the same second get distinct names.
+	sequence *uint64
 }
 
-func NewS3FileBackend() Backend {
-	return S3FileBackend{
-		instanceId:       viper.GetString(ConfigInstanceId),
-		schemaHeadersMap: make(map[string]map[string][]string),
-		payloadStoreMap:  make(map[string]map[string][]*Payload),
-		payloadChannel:   make(chan *Payload),
-		entriesPerFile:   viper.GetInt(ConfigEntriesPerFile),
-		sweepInterval:    viper.GetInt64(ConfigSweepInterval),
+func NewS3FileBackend(config BackendConfig) (Backend, error) {
+	b := S3FileBackend{
+		bufferedBackend: newBufferedBackend(config),
+		instanceId:      viper.GetString(ConfigInstanceId),
+		bucketName:      config.GetString(ConfigS3BucketName),
+		prefix:          config.GetString(ConfigS3Prefix),
+		nullValue:       config.GetString(ConfigNullValue),
+		format:          config.Format(ConfigS3FileFormat),
+		sequence:        new(uint64),
 	}
-}
 
-func (b S3FileBackend) Run() {
 	var err error
-	b.client, err = minio.New(
-		viper.GetString(ConfigS3Endpoint),
-		viper.GetString(ConfigS3AccessKeyId),
-		viper.GetString(ConfigS3SecretAccessKey),
-		viper.GetBool(ConfigS3UseSSL))
-	checkError("cannot create minio client", err)
-
-	exists, err := b.client.BucketExists(viper.GetString(ConfigS3BucketName))
-	checkError("failed to check if bucket exists", err)
-
-	if !exists {
-		log.Fatalln("Bucket does not exist. Please create it before trying again.")
+	b.client, err = NewS3Client(config)
+	if err != nil {
+		return nil, err
 	}
 
-	for {
-		select {
-		case payload := <-b.payloadChannel:
-			b.updateHeadersFromPayload(payload)
-			b.storePayload(payload)
-			b.writeFileIfNecessary(payload.Warehouse, payload.Schema)
-		}
+	b.objectOptions, err = NewS3ObjectOptions(config)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (b S3FileBackend) GetPayloadChannel() chan<- *Payload {
-	return b.payloadChannel
+	// Every backend has a spool directory of its own, since spooled files are retried into its bucket.
+	b.spool = NewUploadSpool(
+		filepath.Join(config.GetString(ConfigS3SpoolDirectory), config.Name),
+		time.Duration(config.GetInt(ConfigS3RetryInitialMillis))*time.Millisecond,
+		time.Duration(config.GetInt(ConfigS3RetryMaxMillis))*time.Millisecond,
+		b.putObject,
+	)
+
+	return b, nil
 }
 
-func (b S3FileBackend) GetHeaders(warehouse string, schema string) []string {
-	_, okWarehouse := b.schemaHeadersMap[warehouse]
-	if !okWarehouse {
-		b.schemaHeadersMap[warehouse] = make(map[string][]string)
+func (b S3FileBackend) Run() {
+	// The bucket not existing is a mistake in the config, but S3 being unreachable at startup is not, and uploads
+	// are spooled until it is back.
+	exists, err := b.client.BucketExists(b.bucketName)
+	if err != nil {
+		log.Printf("Failed to check if bucket %v exists: %v\n", b.bucketName, err)
+	} else if !exists {
+		log.Fatalf("Bucket %v does not exist. Please create it before trying again.\n", b.bucketName)
 	}
 
-	headers, okSchema := b.schemaHeadersMap[warehouse][schema]
-	if okSchema {
-		return headers
-	}
+	go b.spool.Run()
 
-	headers = []string{}
-	b.schemaHeadersMap[warehouse][schema] = headers
-	return headers
+	b.runLoop(b.writeFile)
 }
 
-func (b S3FileBackend) ClearHeaders(warehouse string, schema string) {
-	delete(b.schemaHeadersMap[warehouse], schema)
-	if len(b.schemaHeadersMap[warehouse]) == 0 {
-		delete(b.schemaHeadersMap, warehouse)
-	}
+// Health reports the backend as unhealthy while there are uploads waiting to be retried.
+func (b S3FileBackend) Health() BackendHealth {
+	return b.spool.Health()
 }
 
-func (b S3FileBackend) SetHeaders(warehouse string, schema string, headers []string) {
-	b.schemaHeadersMap[warehouse][schema] = headers
-}
-
-func (b S3FileBackend) updateHeadersFromPayload(payload *Payload) {
-	var keys []string
-	for key := range payload.Data {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
+func (b S3FileBackend) writeFile(batch *Batch) {
+	encoder := EncoderForSchema(batch.Warehouse, batch.Schema, b.format, b.nullValue)
+	sequence := atomic.AddUint64(b.sequence, 1)
+	fileName := b.prefix + fmt.Sprintf("%v-%v-%v-%v%v-%06d.%v", batch.Warehouse, batch.Schema, b.instanceId, partitionName(batch), time.Now().Unix(), sequence, encoder.FileExtension())
 
-	oldKeys := b.GetHeaders(payload.Warehouse, payload.Schema)
+	var buffer bytes.Buffer
+	writer := encoder.NewWriter(&buffer)
+	writer.WriteHeader(batch.Headers)
 
-	for _, newKey := range keys {
-		found := false
-		for _, oldKey := range oldKeys {
-			if oldKey == newKey {
-				found = true
-				break
-			}
-		}
-		if !found {
-			oldKeys = append(oldKeys, newKey)
-		}
+	for _, payload := range batch.Payloads {
+		writer.WriteRecord(batch.Headers, payload)
 	}
 
-	b.SetHeaders(payload.Warehouse, payload.Schema, oldKeys)
-}
-
-func (b S3FileBackend) storePayload(payload *Payload) {
-	_, okWarehouse := b.payloadStoreMap[payload.Warehouse]
-	if !okWarehouse {
-		b.payloadStoreMap[payload.Warehouse] = make(map[string][]*Payload)
+	if err := writer.Flush(); err != nil {
+		log.Printf("Failed to encode %v payloads for %v: %v\n", len(batch.Payloads), fileName, err)
+		metricUploadsLost.Add(1)
+		return
 	}
 
-	payloads, okPayloads := b.payloadStoreMap[payload.Warehouse][payload.Schema]
-	if !okPayloads {
-		payloads = []*Payload{}
+	request := UploadRequest{
+		Object:      fileName,
+		ContentType: encoder.ContentType(),
+		Metadata:    b.batchMetadata(batch),
 	}
 
-	payloads = append(payloads, payload)
-	b.payloadStoreMap[payload.Warehouse][payload.Schema] = payloads
-}
+	err := b.putObject(request, buffer.Bytes())
+	if err == nil {
+		return
+	}
 
-func (b S3FileBackend) convertPayloadToStringList(payload *Payload) []string {
-	keys := b.GetHeaders(payload.Warehouse, payload.Schema)
+	log.Printf("Failed to upload %v, spooling it: %v\n", fileName, err)
+	metricUploadsFailed.Add(1)
 
-	var stringList []string
-	stringList = append(stringList, payload.Id, payload.Source, fmt.Sprintf("%v", payload.ServerTimestamp), fmt.Sprintf("%v", payload.ClientTimestamp))
-	for _, key := range keys {
-		data, ok := payload.Data[key]
-		if !ok {
-			data = ""
-		}
-		stringList = append(stringList, fmt.Sprintf("%v", data))
+	if err := b.spool.Store(request, buffer.Bytes(), err); err != nil {
+		log.Printf("Failed to spool %v, its %v payloads are lost: %v\n", fileName, len(batch.Payloads), err)
+		metricUploadsLost.Add(1)
 	}
-	return stringList
 }
 
-func (b S3FileBackend) writeFileIfNecessary(warehouse string, schema string) {
-	payloads := b.payloadStoreMap[warehouse][schema]
-
-	log.Printf("Payloads Length for Warehouse: %v and Schema: %v is: %v\n", warehouse, schema, len(payloads))
+func (b S3FileBackend) putObject(request UploadRequest, data []byte) error {
+	options := b.objectOptions
+	options.ContentType = request.ContentType
+	options.UserMetadata = request.Metadata
 
-	if len(payloads) < b.entriesPerFile {
-		return
+	_, err := b.client.PutObject(b.bucketName, request.Object, io.Reader(bytes.NewReader(data)), int64(len(data)), options)
+	if err != nil && isPermanentS3Error(err) {
+		return PermanentUploadError(err)
 	}
+	return err
+}
 
-	fileName := fmt.Sprintf("%v-%v-%v-%v.csv", warehouse, schema, b.instanceId, time.Now().Unix())
-
-	var buffer bytes.Buffer
-	bufferWriter := bufio.NewWriter(&buffer)
-
-	writer := csv.NewWriter(bufferWriter)
-	writer.Comma = '|'
-
-	headers := b.GetHeaders(warehouse, schema)
-	headers = append([]string{"id", "source", "server_timestamp", "client_timestamp"}, headers...)
-	writer.Write(headers)
+// S3 errors that are about the time or credentials of a request, rather than about the object, and so can go away.
+var transientS3ErrorCodes = map[string]bool{
+	"RequestTimeout":        true,
+	"RequestTimeTooSkewed":  true,
+	"ExpiredToken":          true,
+	"TokenRefreshRequired":  true,
+	"SlowDown":              true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+}
 
-	for _, payload := range payloads {
-		stringList := b.convertPayloadToStringList(payload)
-		writer.Write(stringList)
+// isPermanentS3Error returns true if S3 rejected the upload itself, for example because access to the prefix is
+// denied or the encryption key is invalid, so that sending it again cannot succeed.
+func isPermanentS3Error(err error) bool {
+	response := minio.ToErrorResponse(err)
+	if transientS3ErrorCodes[response.Code] {
+		return false
 	}
 
-	writer.Flush()
-
-	err := bufferWriter.Flush()
-	checkError("failed to flush buffer", err)
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusLengthRequired, http.StatusRequestEntityTooLarge:
+		return true
+	}
+	return false
+}
 
-	_, err = b.client.PutObject(viper.GetString(ConfigS3BucketName), fileName, io.Reader(&buffer), int64(buffer.Len()), minio.PutObjectOptions{ContentType: "text/plain"})
-	checkError("failed to put object to S3", err)
+// batchMetadata describes the batch in the user metadata of its object, so that what it holds can be told without
+// downloading it.
+func (b S3FileBackend) batchMetadata(batch *Batch) map[string]string {
+	var minTimestamp, maxTimestamp int64
+	for i, payload := range batch.Payloads {
+		if i == 0 || payload.ServerTimestamp < minTimestamp {
+			minTimestamp = payload.ServerTimestamp
+		}
+		if i == 0 || payload.ServerTimestamp > maxTimestamp {
+			maxTimestamp = payload.ServerTimestamp
+		}
+	}
 
-	b.ClearHeaders(warehouse, schema)
-	delete(b.payloadStoreMap[warehouse], schema)
-	if len(b.payloadStoreMap[warehouse]) == 0 {
-		delete(b.payloadStoreMap, warehouse)
+	return map[string]string{
+		"Instance-Id":          b.instanceId,
+		"Rows":                 strconv.Itoa(len(batch.Payloads)),
+		"Columns":              strconv.Itoa(len(batch.Headers)),
+		"Min-Server-Timestamp": strconv.FormatInt(minTimestamp, 10),
+		"Max-Server-Timestamp": strconv.FormatInt(maxTimestamp, 10),
 	}
 }
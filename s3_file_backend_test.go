@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/minio/minio-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3FileBackendBatchMetadata(t *testing.T) {
+	b := S3FileBackend{instanceId: "abcd1234"}
+
+	payloads := []*Payload{
+		{ServerTimestamp: 1500, Data: map[string]interface{}{"user_id": "a", "duration": 12}},
+		{ServerTimestamp: 1000, Data: map[string]interface{}{"user_id": "b", "page": "home"}},
+		{ServerTimestamp: 2000, Data: map[string]interface{}{"user_id": "c"}, Server: map[string]interface{}{ColumnWarnings: "renamed userId to user_id"}},
+	}
+
+	batch := &Batch{Payloads: payloads}
+	for _, payload := range payloads {
+		batch.Headers = MergeColumns(batch.Headers, payload)
+	}
+
+	// The fixed columns every file starts with are not counted, only the columns of the schema.
+	for _, column := range fixedColumns {
+		assert.NotContains(t, batch.Headers, column)
+	}
+
+	assert.Equal(t, map[string]string{
+		"Instance-Id":          "abcd1234",
+		"Rows":                 "3",
+		"Columns":              "4",
+		"Min-Server-Timestamp": "1000",
+		"Max-Server-Timestamp": "2000",
+	}, b.batchMetadata(batch))
+}
+
+func TestIsPermanentS3Error(t *testing.T) {
+	assert.True(t, isPermanentS3Error(minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}))
+	assert.True(t, isPermanentS3Error(minio.ErrInvalidArgument("SSE-C keys need TLS")))
+	assert.False(t, isPermanentS3Error(minio.ErrorResponse{StatusCode: http.StatusBadRequest, Code: "ExpiredToken"}))
+	assert.False(t, isPermanentS3Error(minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "InvalidAccessKeyId"}))
+	assert.False(t, isPermanentS3Error(minio.ErrorResponse{StatusCode: http.StatusInternalServerError, Code: "InternalError"}))
+	assert.False(t, isPermanentS3Error(minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchBucket"}))
+	assert.False(t, isPermanentS3Error(errors.New("dial tcp: connection refused")))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+const (
+	// Requests for the schema are rejected with an error, so clients can see it is switched off.
+	DisableReject = "reject"
+	// Requests for the schema are accepted, but the payloads are thrown away.
+	DisableDrop = "drop"
+)
+
+// CheckSchemaEnabled returns an error message if the payload's schema has been switched off with Disable: reject.
+func CheckSchemaEnabled(payload *Payload) *string {
+	if GetSchemaString(payload.Warehouse, payload.Schema, ConfigDisable) == DisableReject {
+		return newString(fmt.Sprintf("Schema \"%v\" in warehouse \"%v\" is currently disabled", payload.Schema, payload.Warehouse))
+	}
+	return nil
+}
+
+// Sampler drops payloads of schemas switched off with Disable: drop, and keeps only the configured SampleRate
+// fraction of the rest. Sampling is decided by a hash of the source, so all events of a source are either kept
+// or dropped together. Both settings are read on every payload, so they follow changes to the config file.
+type Sampler struct{}
+
+func NewSampler() *Sampler {
+	return &Sampler{}
+}
+
+func (s *Sampler) Enrich(payload *Payload) bool {
+	switch disable := GetSchemaString(payload.Warehouse, payload.Schema, ConfigDisable); disable {
+	case "", DisableReject:
+	case DisableDrop:
+		return false
+	default:
+		log.Printf("Unknown Disable setting \"%v\" for warehouse: %v and schema: %v\n", disable, payload.Warehouse, payload.Schema)
+	}
+
+	rate := GetSchemaFloat64(payload.Warehouse, payload.Schema, ConfigSampleRate)
+	if rate >= 1 {
+		return true
+	}
+
+	return SampleFraction(payload.Warehouse, payload.Schema, payload.Source) < rate
+}
+
+// SampleFraction maps the source to a fixed number in [0, 1) for the warehouse and schema.
+func SampleFraction(warehouse string, schema string, source string) float64 {
+	sum := sha256.Sum256([]byte(warehouse + "/" + schema + "/" + source))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / float64(1<<53)
+}
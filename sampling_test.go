@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	defer LoadSettings()
+	defer viper.Reset()
+	viper.Set(ConfigSampleRate, 1.0)
+	viper.Set("Warehouses.dev.Schemas.noisy.SampleRate", 0.1)
+	viper.Set("Warehouses.dev.Schemas.broken.Disable", DisableDrop)
+	viper.Set("Warehouses.dev.Schemas.rejected.Disable", DisableReject)
+	LoadSettings()
+
+	s := NewSampler()
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		payload := &Payload{Warehouse: "dev", Schema: "noisy", Source: fmt.Sprintf("source-%v", i)}
+		if s.Enrich(payload) {
+			kept++
+			// The same source is always sampled the same way.
+			assert.True(t, s.Enrich(payload))
+		}
+	}
+	assert.InDelta(t, 1000, kept, 150)
+
+	assert.True(t, s.Enrich(&Payload{Warehouse: "dev", Schema: "events", Source: "a"}))
+	assert.False(t, s.Enrich(&Payload{Warehouse: "dev", Schema: "broken", Source: "a"}))
+
+	assert.Nil(t, CheckSchemaEnabled(&Payload{Warehouse: "dev", Schema: "events"}))
+	assert.NotNil(t, CheckSchemaEnabled(&Payload{Warehouse: "dev", Schema: "rejected"}))
+}
+
+func TestSamplerFollowsConfigReloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer LoadSettings()
+	defer viper.Reset()
+
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig := func(rate string) {
+		config := "Warehouses:\n  dev:\n    Schemas:\n      noisy:\n        SampleRate: " + rate + "\n"
+		assert.Nil(t, ioutil.WriteFile(path, []byte(config), 0644))
+	}
+	writeConfig("1")
+
+	viper.Set(ConfigFile, path)
+	setupConfig()
+	watchConfig()
+	// Removing the file stops watching it.
+	defer os.Remove(path)
+
+	s := NewSampler()
+	payload := &Payload{Warehouse: "dev", Schema: "noisy", Source: "a"}
+	assert.True(t, s.Enrich(payload))
+
+	// Payloads keep being handled while the file is reloaded, for the race detector to check with go test -race.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					other := &Payload{Warehouse: "dev", Schema: "noisy", Source: "b"}
+					CheckSchemaEnabled(other)
+					s.Enrich(other)
+				}
+			}
+		}()
+	}
+
+	writeConfig("0")
+	reloaded := false
+	for i := 0; i < 250 && !reloaded; i++ {
+		time.Sleep(20 * time.Millisecond)
+		reloaded = GetSchemaFloat64("dev", "noisy", ConfigSampleRate) == 0
+	}
+
+	close(done)
+	wg.Wait()
+
+	assert.True(t, reloaded)
+	assert.False(t, s.Enrich(payload))
+}
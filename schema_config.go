@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Settings is a copy of the config as it was when it was last loaded. Everything looked up while payloads are
+// handled reads it rather than viper, which cannot be read while the config file is being reloaded. Each reload
+// replaces the copy with a new one, and a copy is never changed once it has been taken.
+type Settings struct {
+	values map[string]interface{}
+}
+
+var currentSettings atomic.Value
+
+// LoadSettings takes a copy of the config, which CurrentSettings returns from then on.
+func LoadSettings() {
+	currentSettings.Store(&Settings{values: viper.AllSettings()})
+}
+
+// CurrentSettings returns the copy of the config taken when it was last loaded, which is empty if it never was.
+func CurrentSettings() *Settings {
+	if settings, ok := currentSettings.Load().(*Settings); ok {
+		return settings
+	}
+	return &Settings{}
+}
+
+// find returns the value of the setting. Keys are matched case insensitively, with nested settings separated by
+// dots, the same way as in viper.
+func (s *Settings) find(key string) (interface{}, bool) {
+	var value interface{} = s.values
+	for _, part := range strings.Split(strings.ToLower(key), ".") {
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = values[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (s *Settings) IsSet(key string) bool {
+	_, ok := s.find(key)
+	return ok
+}
+
+func (s *Settings) GetString(key string) string {
+	value, _ := s.find(key)
+	return cast.ToString(value)
+}
+
+func (s *Settings) GetInt(key string) int {
+	value, _ := s.find(key)
+	return cast.ToInt(value)
+}
+
+func (s *Settings) GetFloat64(key string) float64 {
+	value, _ := s.find(key)
+	return cast.ToFloat64(value)
+}
+
+func (s *Settings) GetBool(key string) bool {
+	value, _ := s.find(key)
+	return cast.ToBool(value)
+}
+
+// AllSettings returns every setting, nested the way they are in the config file. The maps must not be changed.
+func (s *Settings) AllSettings() map[string]interface{} {
+	return s.values
+}
+
+// SchemaKey returns the most specific key that is set for the given setting. Settings can be overridden for a
+// single warehouse, or for a single schema within a warehouse, in the config file:
+//  Warehouses:
+//    dev:
+//      NestedDataMode: flatten
+//      Schemas:
+//        events:
+//          NestedDataMode: reject
+func (s *Settings) SchemaKey(warehouse string, schema string, key string) string {
+	schemaKey := fmt.Sprintf("Warehouses.%v.Schemas.%v.%v", warehouse, schema, key)
+	if s.IsSet(schemaKey) {
+		return schemaKey
+	}
+
+	warehouseKey := fmt.Sprintf("Warehouses.%v.%v", warehouse, key)
+	if s.IsSet(warehouseKey) {
+		return warehouseKey
+	}
+
+	return key
+}
+
+func GetSchemaString(warehouse string, schema string, key string) string {
+	settings := CurrentSettings()
+	return settings.GetString(settings.SchemaKey(warehouse, schema, key))
+}
+
+func GetSchemaInt(warehouse string, schema string, key string) int {
+	settings := CurrentSettings()
+	return settings.GetInt(settings.SchemaKey(warehouse, schema, key))
+}
+
+func GetSchemaFloat64(warehouse string, schema string, key string) float64 {
+	settings := CurrentSettings()
+	return settings.GetFloat64(settings.SchemaKey(warehouse, schema, key))
+}
+
+func GetSchemaBool(warehouse string, schema string, key string) bool {
+	settings := CurrentSettings()
+	return settings.GetBool(settings.SchemaKey(warehouse, schema, key))
+}
+
+// GetStringList returns a list setting, which can be given either as a list in the config file or as a comma
+// separated string in an environment variable.
+func GetStringList(key string) []string {
+	var list []string
+	for _, item := range viper.GetStringSlice(key) {
+		for _, part := range strings.Split(item, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				list = append(list, part)
+			}
+		}
+	}
+	return list
+}
+
+// defaultPattern treats an empty glob pattern as matching everything.
+func defaultPattern(pattern string) string {
+	if pattern == "" {
+		return "*"
+	}
+	return pattern
+}
+
+// matchPattern matches a warehouse, schema or key name against a glob pattern.
+func matchPattern(pattern string, name string) bool {
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
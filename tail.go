@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often an idle tail stream is sent a comment, so that proxies do not close it.
+const tailKeepAliveInterval = 15 * time.Second
+
+// TailBroadcaster keeps the most recently accepted payloads in a ring buffer for live tailing. Publishing never
+// waits for viewers: a viewer that falls more than a buffer's length behind skips the payloads it missed.
+type TailBroadcaster struct {
+	mutex    sync.Mutex
+	entries  []*Payload
+	next     uint64
+	notify   chan struct{}
+	watchers int32
+}
+
+func NewTailBroadcaster(size int) *TailBroadcaster {
+	if size < 1 {
+		size = 1
+	}
+
+	return &TailBroadcaster{
+		entries: make([]*Payload, size),
+		notify:  make(chan struct{}),
+	}
+}
+
+// Publish adds the payload to the ring buffer and wakes up the viewers. It does nothing while nobody is watching.
+func (b *TailBroadcaster) Publish(payload *Payload) {
+	if b == nil || atomic.LoadInt32(&b.watchers) == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	b.entries[b.next%uint64(len(b.entries))] = payload
+	b.next++
+	close(b.notify)
+	b.notify = make(chan struct{})
+	b.mutex.Unlock()
+}
+
+// Watch registers a viewer, and returns the position of the next payload to be published. Every call must be
+// matched by a call to Unwatch.
+func (b *TailBroadcaster) Watch() uint64 {
+	atomic.AddInt32(&b.watchers, 1)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.next
+}
+
+func (b *TailBroadcaster) Unwatch() {
+	atomic.AddInt32(&b.watchers, -1)
+}
+
+// Since returns the payloads published from position onwards that are still in the buffer, how many were missed
+// because they have already been overwritten, the position to continue from, and a channel that is closed when
+// something new is published.
+func (b *TailBroadcaster) Since(position uint64) ([]*Payload, uint64, uint64, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var missed uint64
+	if size := uint64(len(b.entries)); b.next-position > size {
+		missed = b.next - position - size
+		position = b.next - size
+	}
+
+	payloads := make([]*Payload, 0, b.next-position)
+	for i := position; i < b.next; i++ {
+		payloads = append(payloads, b.entries[i%uint64(len(b.entries))])
+	}
+
+	return payloads, missed, b.next, b.notify
+}
+
+// TailPayloads streams accepted payloads as Server-Sent Events, from the moment the request is made. The
+// warehouse, schema and source query parameters are glob patterns that narrow down which payloads are sent.
+func TailPayloads(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	warehouse := defaultPattern(query.Get("warehouse"))
+	schema := defaultPattern(query.Get("schema"))
+	source := defaultPattern(query.Get("source"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	position := tail.Watch()
+	defer tail.Unwatch()
+
+	keepAlive := time.NewTicker(tailKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		payloads, missed, next, notify := tail.Since(position)
+		position = next
+
+		if missed > 0 {
+			fmt.Fprintf(w, "event: missed\ndata: %v\n\n", missed)
+		}
+
+		for _, payload := range payloads {
+			if !matchPattern(warehouse, payload.Warehouse) || !matchPattern(schema, payload.Schema) || !matchPattern(source, payload.Source) {
+				continue
+			}
+
+			data, err := json.Marshal(payload)
+			if err != nil {
+				log.Printf("Failed to encode payload for tail: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %v\nevent: payload\ndata: %s\n\n", payload.Id, data)
+		}
+
+		if missed > 0 || len(payloads) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-notify:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailBroadcasterSkipsWhenNobodyWatches(t *testing.T) {
+	b := NewTailBroadcaster(4)
+	b.Publish(&Payload{Id: "unseen"})
+
+	position := b.Watch()
+	defer b.Unwatch()
+
+	payloads, missed, _, _ := b.Since(position)
+	assert.Empty(t, payloads)
+	assert.Equal(t, uint64(0), missed)
+}
+
+func TestTailBroadcasterRingBuffer(t *testing.T) {
+	b := NewTailBroadcaster(3)
+	position := b.Watch()
+	defer b.Unwatch()
+
+	_, _, _, notify := b.Since(position)
+	b.Publish(&Payload{Id: "1"})
+
+	select {
+	case <-notify:
+	default:
+		assert.Fail(t, "publishing did not wake up the viewer")
+	}
+
+	payloads, missed, position, _ := b.Since(position)
+	assert.Equal(t, uint64(0), missed)
+	if assert.Len(t, payloads, 1) {
+		assert.Equal(t, "1", payloads[0].Id)
+	}
+
+	for _, id := range []string{"2", "3", "4", "5", "6"} {
+		b.Publish(&Payload{Id: id})
+	}
+
+	payloads, missed, position, _ = b.Since(position)
+	assert.Equal(t, uint64(2), missed)
+	if assert.Len(t, payloads, 3) {
+		assert.Equal(t, "4", payloads[0].Id)
+		assert.Equal(t, "6", payloads[2].Id)
+	}
+
+	payloads, missed, _, _ = b.Since(position)
+	assert.Empty(t, payloads)
+	assert.Equal(t, uint64(0), missed)
+}
+
+func TestTailPayloads(t *testing.T) {
+	defer func(old *TailBroadcaster) { tail = old }(tail)
+	tail = NewTailBroadcaster(10)
+
+	server := httptest.NewServer(http.HandlerFunc(TailPayloads))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request, _ := http.NewRequest("GET", server.URL+"/v0/tail?schema=click*", nil)
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&tail.watchers) == 1
+	}, time.Second, time.Millisecond)
+
+	tail.Publish(&Payload{Id: "a", Warehouse: "dev", Schema: "events"})
+	tail.Publish(&Payload{Id: "b", Warehouse: "dev", Schema: "clicks"})
+
+	reader := bufio.NewReader(response.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if !assert.Nil(t, err) {
+			return
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	assert.Equal(t, "id: b", lines[0])
+	assert.Equal(t, "event: payload", lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], `data: {"id":"b","warehouse":"dev"`))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadRequest describes an object to upload, apart from its contents.
+type UploadRequest struct {
+	Object      string            `json:"object"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// Spooled files that can never be uploaded are moved into this directory inside the spool, where they can be looked
+// into, and moved back into the spool to be retried once the problem is fixed.
+const quarantineDirectory = "quarantine"
+
+// permanentUploadError is an upload failure that trying again cannot fix, such as access to the object being denied.
+type permanentUploadError struct {
+	error
+}
+
+// PermanentUploadError marks the error of a failed upload as one that retrying will not fix.
+func PermanentUploadError(err error) error {
+	return permanentUploadError{err}
+}
+
+func IsPermanentUploadError(err error) bool {
+	_, ok := err.(permanentUploadError)
+	return ok
+}
+
+// UploadSpool keeps files that failed to upload on local disk, and retries them in the background with exponential
+// backoff until they succeed. Each spooled file is stored as a .data file holding its contents, next to a .json file
+// holding its UploadRequest, so spooled files survive a restart of the server. Files that fail permanently are
+// quarantined instead of being retried.
+type UploadSpool struct {
+	directory      string
+	upload         func(request UploadRequest, data []byte) error
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	wake chan struct{}
+
+	// How often each spooled file has failed to upload since the server started. Only used by Run.
+	failures map[string]int
+
+	mutex         *sync.Mutex
+	lastError     *string
+	lastErrorTime *int64
+}
+
+func NewUploadSpool(directory string, initialBackoff time.Duration, maxBackoff time.Duration, upload func(request UploadRequest, data []byte) error) UploadSpool {
+	return UploadSpool{
+		directory:      directory,
+		upload:         upload,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		wake:           make(chan struct{}, 1),
+		failures:       make(map[string]int),
+		mutex:          &sync.Mutex{},
+		lastError:      new(string),
+		lastErrorTime:  new(int64),
+	}
+}
+
+// Store spools a file whose upload failed with uploadErr, to be retried later. If the error is permanent, the file is
+// quarantined straight away.
+func (s UploadSpool) Store(request UploadRequest, data []byte, uploadErr error) error {
+	s.recordError(uploadErr)
+
+	directory := s.directory
+	permanent := IsPermanentUploadError(uploadErr)
+	if permanent {
+		directory = filepath.Join(s.directory, quarantineDirectory)
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	// Names start with the time, so that files are retried in the order they were spooled.
+	name := fmt.Sprintf("%020d-%v", time.Now().UnixNano(), strings.Replace(request.Object, "/", "_", -1))
+
+	if err := writeFileAtomically(filepath.Join(directory, name+".data"), data); err != nil {
+		return err
+	}
+
+	description, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	// The description is written last, since a spooled file only counts once it has one.
+	if err := writeFileAtomically(filepath.Join(directory, name+".json"), description); err != nil {
+		return err
+	}
+
+	if permanent {
+		log.Printf("Quarantined %v, which cannot be uploaded: %v\n", request.Object, uploadErr)
+		metricUploadsLost.Add(1)
+		return nil
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run retries the spooled files, oldest first. After a failure it waits before trying again, twice as long each
+// time up to the maximum backoff. It never returns.
+func (s UploadSpool) Run() {
+	backoff := s.initialBackoff
+
+	for {
+		names, err := s.list()
+		if err != nil {
+			log.Printf("Cannot list spooled uploads in %v: %v\n", s.directory, err)
+		}
+
+		if len(names) == 0 {
+			backoff = s.initialBackoff
+			<-s.wake
+			continue
+		}
+
+		if err := s.retry(names); err != nil {
+			s.recordError(err)
+			log.Printf("Retrying spooled uploads in %v: %v\n", backoff, err)
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > s.maxBackoff {
+				backoff = s.maxBackoff
+			}
+			continue
+		}
+
+		backoff = s.initialBackoff
+	}
+}
+
+// retry uploads the spooled files, oldest first among those that failed the fewest times, so that a file that keeps
+// failing does not hold up the others for good. Files that fail permanently are quarantined. It stops at the first
+// file that fails for a reason that may go away, since that usually means S3 cannot be reached at all.
+func (s UploadSpool) retry(names []string) error {
+	sort.SliceStable(names, func(i, j int) bool {
+		return s.failures[names[i]] < s.failures[names[j]]
+	})
+
+	for _, name := range names {
+		basePath := filepath.Join(s.directory, name)
+
+		description, err := ioutil.ReadFile(basePath + ".json")
+		if err != nil {
+			return err
+		}
+
+		var request UploadRequest
+		if err := json.Unmarshal(description, &request); err != nil {
+			s.quarantine(name, fmt.Errorf("unreadable description: %v", err))
+			continue
+		}
+
+		data, err := ioutil.ReadFile(basePath + ".data")
+		if os.IsNotExist(err) {
+			s.quarantine(name, fmt.Errorf("data file is missing"))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.upload(request, data); err != nil {
+			if IsPermanentUploadError(err) {
+				s.quarantine(name, err)
+				continue
+			}
+			s.failures[name]++
+			return err
+		}
+
+		log.Printf("Uploaded spooled file %v\n", request.Object)
+		s.remove(basePath)
+		delete(s.failures, name)
+		metricUploadsRetried.Add(1)
+	}
+	return nil
+}
+
+// quarantine moves a spooled file that can never be uploaded out of the way of the others.
+func (s UploadSpool) quarantine(name string, err error) {
+	log.Printf("Quarantining spooled upload %v, which cannot be uploaded: %v\n", name, err)
+	s.recordError(err)
+	delete(s.failures, name)
+	metricUploadsLost.Add(1)
+
+	directory := filepath.Join(s.directory, quarantineDirectory)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		log.Printf("Cannot quarantine spooled upload %v: %v\n", name, err)
+		return
+	}
+
+	// The data goes first, and the description last, as when the file was spooled.
+	for _, extension := range []string{".data", ".json"} {
+		err := os.Rename(filepath.Join(s.directory, name+extension), filepath.Join(directory, name+extension))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Cannot quarantine spooled upload %v: %v\n", name, err)
+		}
+	}
+}
+
+func (s UploadSpool) remove(basePath string) {
+	// The description goes first, so that a crash in between never leaves a description without its data.
+	if err := os.Remove(basePath + ".json"); err != nil {
+		log.Printf("Cannot remove spooled upload %v: %v\n", basePath, err)
+		return
+	}
+	os.Remove(basePath + ".data")
+}
+
+// list returns the names of the spooled files, oldest first.
+func (s UploadSpool) list() ([]string, error) {
+	return listSpooled(s.directory)
+}
+
+func listSpooled(directory string) ([]string, error) {
+	files, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if name := file.Name(); strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			names = append(names, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s UploadSpool) recordError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*s.lastError = err.Error()
+	*s.lastErrorTime = GetMillis()
+}
+
+// Health describes the spooled files, and the last upload error.
+func (s UploadSpool) Health() BackendHealth {
+	health := BackendHealth{Healthy: true}
+
+	names, err := s.list()
+	if err != nil {
+		health.Healthy = false
+		health.LastError = err.Error()
+	}
+
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(s.directory, name+".data")); err == nil {
+			health.SpooledFiles++
+			health.SpooledBytes += info.Size()
+		}
+	}
+
+	// Quarantined files stay until someone deals with them, so the backend stays unhealthy until then too.
+	quarantined, err := listSpooled(filepath.Join(s.directory, quarantineDirectory))
+	if err != nil {
+		health.Healthy = false
+		health.LastError = err.Error()
+	}
+	health.QuarantinedFiles = len(quarantined)
+
+	if health.SpooledFiles > 0 || health.QuarantinedFiles > 0 {
+		health.Healthy = false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if health.LastError == "" {
+		health.LastError = *s.lastError
+	}
+	health.LastErrorTime = *s.lastErrorTime
+
+	return health
+}
+
+// writeFileAtomically writes the file through a hidden temporary file, so that it is never seen half written.
+func writeFileAtomically(path string, data []byte) error {
+	tempPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
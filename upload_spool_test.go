@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadSpoolRetry(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uplink-spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	var uploaded []UploadRequest
+	var contents []string
+	failing := errors.New("connection refused")
+	upload := func(request UploadRequest, data []byte) error {
+		if failing != nil {
+			return failing
+		}
+		uploaded = append(uploaded, request)
+		contents = append(contents, string(data))
+		return nil
+	}
+
+	s := NewUploadSpool(directory, time.Millisecond, time.Millisecond, upload)
+	assert.True(t, s.Health().Healthy)
+
+	first := UploadRequest{Object: "prefix/dev-events-1.csv", ContentType: "text/csv", Metadata: map[string]string{"rows": "2"}}
+	second := UploadRequest{Object: "prefix/dev-events-2.csv", ContentType: "text/csv"}
+	assert.Nil(t, s.Store(first, []byte("a,b\n1,2\n"), failing))
+	assert.Nil(t, s.Store(second, []byte("a,b\n3,4\n"), failing))
+
+	health := s.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, 2, health.SpooledFiles)
+	assert.Equal(t, int64(16), health.SpooledBytes)
+	assert.Equal(t, "connection refused", health.LastError)
+	assert.True(t, health.LastErrorTime > 0)
+
+	// Failed retries leave everything spooled.
+	names, err := s.list()
+	assert.Nil(t, err)
+	assert.Len(t, names, 2)
+	assert.NotNil(t, s.retry(names))
+	assert.Equal(t, 2, s.Health().SpooledFiles)
+
+	// Spooled files outlive the spool, and are retried in order by the next one.
+	failing = nil
+	s = NewUploadSpool(directory, time.Millisecond, time.Millisecond, upload)
+	names, err = s.list()
+	assert.Nil(t, err)
+	assert.Nil(t, s.retry(names))
+
+	assert.Equal(t, []UploadRequest{first, second}, uploaded)
+	assert.Equal(t, []string{"a,b\n1,2\n", "a,b\n3,4\n"}, contents)
+	assert.True(t, s.Health().Healthy)
+
+	files, err := ioutil.ReadDir(directory)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestUploadSpoolRun(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uplink-spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	attempts := make(chan int, 10)
+	count := 0
+	s := NewUploadSpool(directory, time.Millisecond, 4*time.Millisecond, func(request UploadRequest, data []byte) error {
+		count++
+		attempts <- count
+		if count < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+
+	go s.Run()
+
+	assert.Nil(t, s.Store(UploadRequest{Object: "dev-events-1.csv"}, []byte("data"), errors.New("unavailable")))
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case attempt := <-attempts:
+			assert.Equal(t, i, attempt)
+		case <-time.After(time.Second):
+			t.Fatalf("upload was not retried a %v time", i)
+		}
+	}
+
+	// The spooled file is removed just after the successful upload returns.
+	for i := 0; i < 100 && !s.Health().Healthy; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, s.Health().Healthy)
+}
+
+func TestUploadSpoolSkipsFailingFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uplink-spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	var uploaded []string
+	s := NewUploadSpool(directory, time.Millisecond, time.Millisecond, func(request UploadRequest, data []byte) error {
+		switch request.Object {
+		case "denied.csv":
+			return PermanentUploadError(errors.New("AccessDenied"))
+		case "flaky.csv":
+			return errors.New("internal error")
+		}
+		uploaded = append(uploaded, request.Object)
+		return nil
+	})
+
+	failure := errors.New("connection refused")
+	for _, object := range []string{"denied.csv", "flaky.csv", "good.csv"} {
+		assert.Nil(t, s.Store(UploadRequest{Object: object}, []byte(object), failure))
+	}
+
+	// A file spooled without its data can never be uploaded either.
+	assert.Nil(t, s.Store(UploadRequest{Object: "nodata.csv"}, []byte("nodata"), failure))
+	names, err := s.list()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(filepath.Join(directory, names[3]+".data")))
+
+	// The file that failed permanently is quarantined, and the next one tried. A file that failed for a reason that
+	// may go away ends the attempt, but goes behind the others the next time.
+	assert.NotNil(t, s.retry(names))
+	assert.Empty(t, uploaded)
+
+	names, err = s.list()
+	assert.Nil(t, err)
+	assert.NotNil(t, s.retry(names))
+	assert.Equal(t, []string{"good.csv"}, uploaded)
+
+	names, err = s.list()
+	assert.Nil(t, err)
+	assert.Len(t, names, 1)
+	assert.True(t, strings.HasSuffix(names[0], "flaky.csv"))
+
+	quarantined, err := listSpooled(filepath.Join(directory, quarantineDirectory))
+	assert.Nil(t, err)
+	assert.Len(t, quarantined, 2)
+	assert.True(t, strings.HasSuffix(quarantined[0], "denied.csv"))
+	assert.True(t, strings.HasSuffix(quarantined[1], "nodata.csv"))
+
+	health := s.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, 1, health.SpooledFiles)
+	assert.Equal(t, 2, health.QuarantinedFiles)
+
+	// Uploads that fail permanently in the first place go straight into quarantine.
+	assert.Nil(t, s.Store(UploadRequest{Object: "invalid.csv"}, []byte("invalid"), PermanentUploadError(errors.New("InvalidArgument"))))
+	assert.Equal(t, 1, s.Health().SpooledFiles)
+	assert.Equal(t, 3, s.Health().QuarantinedFiles)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ColumnUserAgentPrefix = "ua_"
+
+	ColumnBrowser        = "ua_browser"
+	ColumnBrowserVersion = "ua_browser_version"
+	ColumnOs             = "ua_os"
+	ColumnOsVersion      = "ua_os_version"
+	ColumnDeviceType     = "ua_device_type"
+	ColumnIsBot          = "ua_is_bot"
+)
+
+const (
+	DeviceTypeDesktop = "desktop"
+	DeviceTypeMobile  = "mobile"
+	DeviceTypeTablet  = "tablet"
+	DeviceTypeBot     = "bot"
+	DeviceTypeUnknown = "unknown"
+)
+
+// UserAgent is the result of parsing a User-Agent header.
+type UserAgent struct {
+	Browser        string
+	BrowserVersion string
+	Os             string
+	OsVersion      string
+	DeviceType     string
+	IsBot          bool
+}
+
+type userAgentRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// Browser rules are checked in order, since most browsers also claim to be the ones they are derived from.
+var browserRules = []userAgentRule{
+	{"Edge", regexp.MustCompile(`(?:Edge|Edg|EdgA|EdgiOS)/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+}
+
+var osRules = []userAgentRule{
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS ([\d_]+)`)},
+	{"Mac OS X", regexp.MustCompile(`Mac OS X ([\d_.]+)`)},
+	{"Android", regexp.MustCompile(`Android ([\d.]+)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+// Crawlers mostly name themselves with a versioned product token ending in "bot", such as Googlebot/2.1, and many
+// link to a page about themselves. Just ending in "bot" is not enough, since device names like Cubot do too.
+var botPattern = regexp.MustCompile(`(?i)[a-z]bot/\d|\b(slackbot|telegrambot)\b|\+https?://|crawl|spider|slurp|facebookexternalhit|headlesschrome|phantomjs|lighthouse|^curl/|^wget/|python-requests|go-http-client|^java/|apache-httpclient`)
+var tabletPattern = regexp.MustCompile(`iPad|Tablet|Kindle|Silk/`)
+var mobilePattern = regexp.MustCompile(`Mobi|iPhone|iPod|Windows Phone`)
+
+// ParseUserAgent extracts the browser, operating system and device type from a User-Agent header. Anything it does
+// not recognise is reported as "Other".
+func ParseUserAgent(header string) UserAgent {
+	ua := UserAgent{
+		Browser:    "Other",
+		Os:         "Other",
+		DeviceType: DeviceTypeUnknown,
+	}
+
+	if header == "" {
+		return ua
+	}
+
+	for _, rule := range browserRules {
+		if match := rule.pattern.FindStringSubmatch(header); match != nil {
+			ua.Browser = rule.name
+			ua.BrowserVersion = match[1]
+			break
+		}
+	}
+
+	for _, rule := range osRules {
+		if match := rule.pattern.FindStringSubmatch(header); match != nil {
+			ua.Os = rule.name
+			ua.OsVersion = strings.Replace(match[1], "_", ".", -1)
+			break
+		}
+	}
+
+	if ua.Os == "Windows" {
+		if version, ok := windowsVersions[ua.OsVersion]; ok {
+			ua.OsVersion = version
+		}
+	}
+
+	switch {
+	case botPattern.MatchString(header):
+		ua.IsBot = true
+		ua.DeviceType = DeviceTypeBot
+	case tabletPattern.MatchString(header), ua.Os == "Android" && !strings.Contains(header, "Mobile"):
+		ua.DeviceType = DeviceTypeTablet
+	case mobilePattern.MatchString(header):
+		ua.DeviceType = DeviceTypeMobile
+	default:
+		ua.DeviceType = DeviceTypeDesktop
+	}
+
+	return ua
+}
+
+// UserAgentEnricher adds the parsed User-Agent of the request as columns, and optionally drops bot traffic.
+type UserAgentEnricher struct {
+	addColumns bool
+	dropBots   bool
+}
+
+func NewUserAgentEnricher() *UserAgentEnricher {
+	return &UserAgentEnricher{
+		addColumns: viper.GetBool(ConfigUserAgentEnrichment),
+		dropBots:   viper.GetBool(ConfigDropBots),
+	}
+}
+
+func (e *UserAgentEnricher) Enrich(payload *Payload) bool {
+	if payload.request == nil || (!e.addColumns && !e.dropBots) {
+		return true
+	}
+
+	ua := ParseUserAgent(payload.request.UserAgent)
+	if ua.IsBot && e.dropBots {
+		return false
+	}
+
+	if e.addColumns {
+		payload.SetServerValue(ColumnBrowser, ua.Browser)
+		payload.SetServerValue(ColumnBrowserVersion, ua.BrowserVersion)
+		payload.SetServerValue(ColumnOs, ua.Os)
+		payload.SetServerValue(ColumnOsVersion, ua.OsVersion)
+		payload.SetServerValue(ColumnDeviceType, ua.DeviceType)
+		payload.SetServerValue(ColumnIsBot, ua.IsBot)
+	}
+
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	for header, expected := range map[string]UserAgent{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "78.0.3904.108", Os: "Windows", OsVersion: "10", DeviceType: DeviceTypeDesktop,
+		},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.3 Safari/605.1.15": {
+			Browser: "Safari", BrowserVersion: "13.0.3", Os: "Mac OS X", OsVersion: "10.15.1", DeviceType: DeviceTypeDesktop,
+		},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_2_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.3 Mobile/15E148 Safari/604.1": {
+			Browser: "Safari", BrowserVersion: "13.0.3", Os: "iOS", OsVersion: "13.2.3", DeviceType: DeviceTypeMobile,
+		},
+		"Mozilla/5.0 (iPad; CPU OS 12_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/78.0.3904.84 Mobile/15E148 Safari/604.1": {
+			Browser: "Chrome", BrowserVersion: "78.0.3904.84", Os: "iOS", OsVersion: "12.4", DeviceType: DeviceTypeTablet,
+		},
+		"Mozilla/5.0 (Linux; Android 10; SM-G975F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/10.2 Chrome/71.0.3578.99 Mobile Safari/537.36": {
+			Browser: "Samsung Internet", BrowserVersion: "10.2", Os: "Android", OsVersion: "10", DeviceType: DeviceTypeMobile,
+		},
+		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:70.0) Gecko/20100101 Firefox/70.0": {
+			Browser: "Firefox", BrowserVersion: "70.0", Os: "Linux", DeviceType: DeviceTypeDesktop,
+		},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.102 Safari/537.36 Edge/18.18362": {
+			Browser: "Edge", BrowserVersion: "18.18362", Os: "Windows", OsVersion: "10", DeviceType: DeviceTypeDesktop,
+		},
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": {
+			Browser: "Other", Os: "Other", DeviceType: DeviceTypeBot, IsBot: true,
+		},
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)": {
+			Browser: "Other", Os: "Other", DeviceType: DeviceTypeBot, IsBot: true,
+		},
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)": {
+			Browser: "Other", Os: "Other", DeviceType: DeviceTypeBot, IsBot: true,
+		},
+		"TelegramBot (like TwitterBot)": {
+			Browser: "Other", Os: "Other", DeviceType: DeviceTypeBot, IsBot: true,
+		},
+		"Mozilla/5.0 (Linux; Android 9; Cubot P40) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.99 Mobile Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "80.0.3987.99", Os: "Android", OsVersion: "9", DeviceType: DeviceTypeMobile,
+		},
+		"Mozilla/5.0 (Linux; Android 10; CUBOT_X30 Build/QP1A.190711.020; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/86.0.4240.99 Mobile Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "86.0.4240.99", Os: "Android", OsVersion: "10", DeviceType: DeviceTypeMobile,
+		},
+		"Mozilla/5.0 (Linux; Android 8.1; Robot) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.99 Mobile Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "80.0.3987.99", Os: "Android", OsVersion: "8.1", DeviceType: DeviceTypeMobile,
+		},
+		"curl/7.64.1": {
+			Browser: "Other", Os: "Other", DeviceType: DeviceTypeBot, IsBot: true,
+		},
+		"": {
+			Browser: "Other", Os: "Other", DeviceType: DeviceTypeUnknown,
+		},
+	} {
+		assert.Equal(t, expected, ParseUserAgent(header), header)
+	}
+}
+
+func TestUserAgentEnricher(t *testing.T) {
+	bot := &Payload{request: &RequestInfo{UserAgent: "curl/7.64.1"}}
+
+	assert.True(t, (&UserAgentEnricher{addColumns: true}).Enrich(bot))
+	assert.Equal(t, true, bot.Server[ColumnIsBot])
+	assert.Equal(t, DeviceTypeBot, bot.Server[ColumnDeviceType])
+
+	assert.False(t, (&UserAgentEnricher{dropBots: true}).Enrich(bot))
+	assert.True(t, (&UserAgentEnricher{dropBots: true}).Enrich(&Payload{request: &RequestInfo{UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:70.0) Gecko/20100101 Firefox/70.0"}}))
+}
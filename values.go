@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// EncodeValue converts a single data value into its textual representation for record based output formats.
+// Numbers keep the precision they were sent with and are never written in exponent notation, and both JSON null
+// and missing values are written as nullValue so they can be told apart from empty strings.
+func EncodeValue(value interface{}, nullValue string) string {
+	switch v := value.(type) {
+	case nil:
+		return nullValue
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return encodeNumber(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(b)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Numbers with a larger exponent than this, which no float64 can hold, are written as they were sent, since writing
+// them out in full would take a client a few bytes and the server a lot of time and memory.
+const maxExpandedExponent = 308
+
+func encodeNumber(number json.Number) string {
+	s := number.String()
+	i := strings.IndexAny(s, "eE")
+	if i < 0 {
+		return s
+	}
+
+	exponent, err := strconv.Atoi(s[i+1:])
+	if err != nil || exponent > maxExpandedExponent || exponent < -maxExpandedExponent {
+		return s
+	}
+
+	f, _, err := big.ParseFloat(s, 10, 256, big.ToNearestEven)
+	if err != nil {
+		return s
+	}
+
+	return f.Text('f', -1)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeValue(t *testing.T) {
+	assert.Equal(t, `\N`, EncodeValue(nil, `\N`))
+	assert.Equal(t, "", EncodeValue("", `\N`))
+	assert.Equal(t, "true", EncodeValue(true, `\N`))
+	assert.Equal(t, "false", EncodeValue(false, `\N`))
+	assert.Equal(t, "1234567890123456789", EncodeValue(json.Number("1234567890123456789"), `\N`))
+	assert.Equal(t, "123.456", EncodeValue(json.Number("123.456"), `\N`))
+	assert.Equal(t, "1234567000", EncodeValue(json.Number("1.234567e+09"), `\N`))
+	assert.Equal(t, "0.00015", EncodeValue(json.Number("1.5E-4"), `\N`))
+	assert.Equal(t, "1"+strings.Repeat("0", 308), EncodeValue(json.Number("1e308"), `\N`))
+	assert.Equal(t, "1e10000000", EncodeValue(json.Number("1e10000000"), `\N`))
+	assert.Equal(t, "1.5E-10000000", EncodeValue(json.Number("1.5E-10000000"), `\N`))
+	assert.Equal(t, "1e99999999999999999999", EncodeValue(json.Number("1e99999999999999999999"), `\N`))
+	assert.Equal(t, "1234567000", EncodeValue(float64(1234567000), `\N`))
+	assert.Equal(t, "42", EncodeValue(int64(42), `\N`))
+	assert.Equal(t, `["a",1]`, EncodeValue([]interface{}{"a", json.Number("1")}, `\N`))
+}